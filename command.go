@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	shellquote "github.com/kballard/go-shellquote"
 )
@@ -15,113 +18,382 @@ type group struct {
 	// paths which precede a group externally
 	// are used by files/dirs/all directives
 	externalPath string
+	// fullPaths is set when the terms already include
+	// externalPath, as it contained a glob
+	fullPaths bool
+	// ref is the group a backref refers to, from 1
+	ref int
+	// linked is set when the group advances in lockstep with
+	// the group before it, rather than looping inside it
+	linked bool
+	// filters transform the group's terms, or for backrefs
+	// the term referred to
+	filters []filter
+	// fields holds the fields of each term read from a csv, tsv
+	// or json file, by name, and is nil for other terms
+	fields []map[string]string
+	// field is set for backrefs to a field of a record
+	field string
+	// stdin is set for the @stdin@ group, whose terms are read from
+	// stdin a line at a time while commands run
+	stdin bool
 }
 
 type command struct {
 	tokens   []string
 	original string
-	template string
+	// nodes holds the parsed command line, literal
+	// text interspersed with groups and backrefs
+	nodes    []node
 	groups   []group
 	commands []string
+	// terms holds the term used from each group for the
+	// command at the same position in commands
+	terms [][]string
+	// results holds the outcome of each command once run
+	results []result
+	// names maps the names of any named groups to their numbers
+	names map[string]int
+	// rules hold the conditions from --where and any inline conditions,
+	// which combinations of terms must meet to become commands
+	rules []*rule
+	// picks holds the index of the term used from each group for the
+	// command being built, for backrefs to fields
+	picks []int
+	// stdin is the position of the @stdin@ group, from 1, or 0 if there
+	// isn't one, and stdinTerm turns a line read from stdin into its term
+	stdin     int
+	stdinTerm func(string) string
+	// inputs holds the part of stdin given to each command when
+	// --split-stdin shares it out between them
+	inputs [][]byte
 }
 
 func newCommand(tokens ...string) (c command) {
 	c.tokens = tokens
 	c.checkFlags()
 	c.getGroups()
-	c.getCommands(0, "", []string{})
+	c.getCommands(0, []string{})
 	return
 }
 
-func newGroup(s string, externalPath string, inSingles state, inDoubles state) (g group) {
-	var terms []string
-	var escaping state
-	lastComma := -1
-	g.hidden, s = isHidden(s)
-	for i, char := range s {
-		if !escaping.on && char == ',' {
-			terms = append(terms, expand(stripSlashes(s[lastComma+1:i]), externalPath, inSingles.on, inDoubles.on)...)
-			lastComma = i
-		}
-		escaping.toggle(char, '\\', true)
-	}
-	terms = append(terms, expand(stripSlashes(s[lastComma+1:len(s)]), externalPath, inSingles.on, inDoubles.on)...)
-	g.externalPath = externalPath
-	g.terms = terms
+// evaluate expands a parsed group into its list of terms
+func (n *groupNode) evaluate() (g group) {
+	g.hidden = n.hidden
+	g.linked = n.linked
+	g.externalPath = n.path
+	g.stdin = n.readsStdin()
+	for _, term := range n.terms {
+		if g.stdin {
+			break
+		}
+		if d, ok := first(term).(*directiveNode); ok && isData(d.kind) {
+			terms, fields := readData(d.kind, unquote(stripSlashes(d.arg), n.inSingles, n.inDoubles))
+			g.fields = append(resizeFields(g.fields, len(g.terms)), fields...)
+			for i, t := range terms {
+				g.terms = append(g.terms, escapeQuotes(addSlashes(t), n.inSingles, n.inDoubles))
+				for k, v := range fields[i] {
+					fields[i][k] = escapeQuotes(addSlashes(v), n.inSingles, n.inDoubles)
+				}
+			}
+			continue
+		}
+		g.terms = append(g.terms, n.expandTerm(term)...)
+		if d, ok := first(term).(*directiveNode); ok && (d.kind == "files" || d.kind == "dirs" || d.kind == "all") && hasGlobs(n.path) {
+			g.fullPaths = true
+		}
+	}
+	for i := range g.terms {
+		g.terms[i] = applyFilters(g.terms[i], n.filters)
+	}
+	if g.fields != nil {
+		g.fields = resizeFields(g.fields, len(g.terms))
+	}
 	return
 }
 
-func (c *command) getCommands(startGroup int, s string, curTerms []string) {
-	var curTerm string
-	if s == "" {
-		s = c.template
+// expandTerm expands a single term of the group, which might be a
+// directive, a plain term, or text mixed with nested groups
+func (n *groupNode) expandTerm(term []node) []string {
+	var text string
+	var nested bool
+	for _, part := range term {
+		switch part := part.(type) {
+		case *directiveNode:
+			arg := stripSlashes(part.arg)
+			if part.kind == "cmd" {
+				// the shell reads the command again, so it needs to be
+				// as it was typed
+				arg = unquote(arg, n.inSingles, n.inDoubles)
+			}
+			return expand(part.kind+":"+arg, n.path, n.inSingles, n.inDoubles)
+		case *literalNode:
+			text += part.text
+		case *groupNode:
+			nested = true
+		}
 	}
-	if len(c.groups) == 0 {
-		c.commands = append(c.commands, s)
+	if !nested {
+		return expand(stripSlashes(text), n.path, n.inSingles, n.inDoubles)
+	}
+	combos := []string{""}
+	for _, part := range term {
+		var terms []string
+		switch part := part.(type) {
+		case *literalNode:
+			terms = []string{escapeQuotes(stripSlashes(part.text), n.inSingles, n.inDoubles)}
+		case *groupNode:
+			part.inSingles, part.inDoubles = n.inSingles, n.inDoubles
+			g := part.evaluate()
+			terms = g.terms
+			if g.hidden {
+				terms = make([]string, len(g.terms))
+			}
+		}
+		var next []string
+		for _, c := range combos {
+			for _, t := range terms {
+				next = append(next, c+t)
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// isBackref reports whether the group is a lone reference to an earlier group
+func (g group) isBackref() bool {
+	return g.ref > 0
+}
+
+// tag builds the text prefixed to each line of output from the command at
+// position i, either from prefixFormat's backrefs or from the terms of its
+// groups, leaving out backrefs as they only repeat earlier terms
+func (c *command) tag(i int) string {
+	if prefixFormat != "" {
+		return regexp.MustCompile(`@\w+@`).ReplaceAllStringFunc(prefixFormat, func(ref string) string {
+			return backref(c.ref(ref[1:len(ref)-1]), c.terms[i])
+		})
+	}
+	var terms []string
+	for g, t := range c.terms[i] {
+		if !c.groups[g].isBackref() {
+			terms = append(terms, t)
+		}
+	}
+	return "[" + strings.Join(terms, " ") + "] "
+}
+
+// ref returns the number of the group a backref refers to, by number or
+// by name, exiting if there's no group with that name
+func (c *command) ref(name string) string {
+	if refName.MatchString(name) {
+		n, ok := c.names[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid backref, there's no group named %s\n", name)
+			os.Exit(4)
+		}
+		return strconv.Itoa(n)
+	}
+	return name
+}
+
+func (c *command) getCommands(startGroup int, curTerms []string) {
+	if startGroup == len(c.groups) {
+		c.commands = append(c.commands, c.build(curTerms))
+		c.terms = append(c.terms, append([]string{}, curTerms...))
 		return
 	}
-	for _, t := range c.groups[startGroup].terms {
-		if len(c.groups[startGroup].terms) == 1 {
-			t = backref(t, curTerms)
+	g := c.groups[startGroup]
+	end := startGroup + 1
+	for end < len(c.groups) && c.groups[end].linked {
+		end++
+	}
+	for k, t := range g.terms {
+		switch {
+		case g.field != "":
+			t = applyFilters(c.groups[g.ref-1].fields[c.picks[g.ref-1]][g.field], g.filters)
+		case g.isBackref():
+			t = applyFilters(backref(t, curTerms), g.filters)
+		}
+		terms := append(curTerms, t)
+		for j, l := range c.groups[startGroup+1 : end] {
+			terms = append(terms, l.terms[k])
+			c.picks[startGroup+1+j] = k
+		}
+		c.picks[startGroup] = k
+		if c.excluded(startGroup, terms) {
+			continue
 		}
-		if c.groups[startGroup].hidden {
-			curTerm = ""
-		} else {
-			curTerm = t
+		c.getCommands(end, terms)
+	}
+}
+
+// excluded reports whether the terms chosen so far fail any of the rules
+// which refer to the groups from startGroup on, as they can be checked as
+// soon as the last group they refer to has a term
+func (c *command) excluded(startGroup int, terms []string) bool {
+	for _, r := range c.rules {
+		if r.last >= startGroup && r.last < len(terms) && !r.holds(terms) {
+			return true
+		}
+	}
+	return false
+}
+
+// link lines the group up with the chain of linked groups before it so
+// that they can advance together, padding or truncating their terms if
+// their lengths differ and linkMismatch allows it
+func (c *command) link(g *group) error {
+	if len(c.groups) == 0 {
+		return errors.New("Linked groups need a group before them to advance with")
+	}
+	start := len(c.groups) - 1
+	for c.groups[start].linked {
+		start--
+	}
+	if c.groups[start].isBackref() {
+		return errors.New("Groups can't be linked to a backref")
+	}
+	if c.groups[start].stdin || g.stdin {
+		return errors.New("Groups can't be linked to @stdin@, as how many terms it has isn't known until it's read")
+	}
+	size, n := len(c.groups[start].terms), len(g.terms)
+	if size == n {
+		return nil
+	}
+	switch {
+	case linkMismatch == "pad" && n > size, linkMismatch == "truncate" && n < size:
+		size = n
+	case linkMismatch == "error":
+		return fmt.Errorf("Linked groups have different lengths, %d terms here but %d in the group before", n, size)
+	}
+	for j := start; j < len(c.groups); j++ {
+		c.groups[j].terms = resize(c.groups[j].terms, size)
+		if c.groups[j].fields != nil {
+			c.groups[j].fields = resizeFields(c.groups[j].fields, size)
 		}
-		if startGroup < len(c.groups)-1 {
-			c.getCommands(startGroup+1, strings.Replace(s, lupGroup(startGroup), curTerm, 1), append(curTerms, t))
-		} else {
-			newCommand := strings.Replace(s, lupGroup(startGroup), curTerm, 1)
-			c.commands = append(c.commands, newCommand)
+	}
+	g.terms = resize(g.terms, size)
+	if g.fields != nil {
+		g.fields = resizeFields(g.fields, size)
+	}
+	return nil
+}
+
+// resize truncates terms to size, or pads it out with empty terms
+func resize(terms []string, size int) []string {
+	if len(terms) >= size {
+		return terms[:size]
+	}
+	return append(terms, make([]string, size-len(terms))...)
+}
+
+// resizeFields truncates fields to size, or pads it out with terms which
+// have no fields
+func resizeFields(fields []map[string]string, size int) []map[string]string {
+	if len(fields) >= size {
+		return fields[:size]
+	}
+	return append(fields, make([]map[string]string, size-len(fields))...)
+}
+
+// build puts a command together from its literal text and the terms
+// chosen for each of its groups
+func (c *command) build(terms []string) string {
+	var b strings.Builder
+	i := 0
+	for _, n := range c.nodes {
+		switch n := n.(type) {
+		case *literalNode:
+			b.WriteString(stripSlashes(n.text))
+		case *groupNode, *backrefNode:
+			g := c.groups[i]
+			if !g.fullPaths {
+				b.WriteString(g.externalPath)
+			}
+			if !g.hidden {
+				b.WriteString(terms[i])
+			}
+			i++
 		}
 	}
+	return b.String()
 }
 
 func (c *command) getGroups() {
-	var escaping bool
-	var path string
-	var curGroup int
-	inSingles := state{on: false}
-	inDoubles := state{on: false}
-	pathStart := -1
-	groupStart := -1
-	for i, char := range c.original {
-		if !escaping {
-			if groupStart == -1 {
-				if pathStart == -1 && char == '/' {
-					pathStart = i
+	nodes, err := parse(c.original)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(16)
+	}
+	c.nodes = nodes
+	c.names = map[string]int{}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *groupNode:
+			if n.name != "" {
+				c.names[n.name] = len(c.groups) + 1
+			}
+			g := n.evaluate()
+			if g.stdin {
+				if c.stdin > 0 {
+					fmt.Fprintln(os.Stderr, &parseError{src: c.original, pos: n.pos, msg: "Only one group can read from stdin"})
+					os.Exit(16)
 				}
-				if pathStart > -1 && char == ' ' {
-					pathStart = -1
+				c.stdin = len(c.groups) + 1
+				c.stdinTerm = func(line string) string {
+					return escapeLine(applyFilters(line, n.filters), n.inSingles, n.inDoubles)
 				}
-				inSingles.toggle(char, '\'', false)
-				inDoubles.toggle(char, '"', false)
 			}
-			if char == '\\' {
-				escaping = true
-			} else if char == delimiter {
-				if pathStart > -1 {
-					path = c.original[pathStart:i]
-				}
-				pathStart = -1
-				if groupStart == -1 {
-					groupStart = i
-				} else {
-					c.groups = append(c.groups, newGroup(c.original[groupStart+1:i], path, inSingles, inDoubles))
-					c.template = strings.Replace(c.template, c.original[groupStart-len(path):i+1], lupGroup(curGroup), 1)
-					path = ""
-					curGroup++
-					groupStart = -1
+			if g.linked {
+				if err := c.link(&g); err != nil {
+					fmt.Fprintln(os.Stderr, &parseError{src: c.original, pos: n.pos, msg: err.Error()})
+					os.Exit(16)
 				}
 			}
-		} else {
-			if char != '\\' {
-				escaping = false
+			c.groups = append(c.groups, g)
+		case *backrefNode:
+			if n.field != "" && !hasField(c.groups[n.ref-1].fields, n.field) {
+				fmt.Fprintf(os.Stderr, "Invalid backref, none of the records in group %d have a field named %s\n", n.ref, n.field)
+				os.Exit(4)
+			}
+			c.groups = append(c.groups, group{ref: n.ref, terms: []string{strconv.Itoa(n.ref)}, filters: n.filters, field: n.field})
+		}
+	}
+	c.picks = make([]int, len(c.groups))
+	if c.stdin > 0 && (resume || rerunFailed) {
+		fmt.Fprintln(os.Stderr, "Flags --resume and --rerun-failed can't be used with @stdin@, as its terms aren't known until they're read")
+		os.Exit(2)
+	}
+	if c.stdin > 0 && splitStdin != "" {
+		fmt.Fprintln(os.Stderr, "Flag --split-stdin can't be used with @stdin@, as stdin is read for its terms")
+		os.Exit(2)
+	}
+	for _, w := range wheres {
+		r, err := parseRule(w)
+		if err == nil {
+			err = r.resolve(len(c.groups), c.names)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Flag --where %s\n  %s\n", w, err)
+			os.Exit(2)
+		}
+		c.rules = append(c.rules, r)
+	}
+	for _, n := range nodes {
+		if n, ok := n.(*conditionNode); ok {
+			if err := n.rule.resolve(len(c.groups), c.names); err != nil {
+				fmt.Fprintln(os.Stderr, &parseError{src: c.original, pos: n.pos, msg: err.Error()})
+				os.Exit(16)
 			}
+			c.rules = append(c.rules, n.rule)
 		}
 	}
-	c.template = stripSlashes(c.template)
+	// check any names in the prefix format now, rather than once running
+	for _, ref := range regexp.MustCompile(`@(\w+)@`).FindAllStringSubmatch(prefixFormat, -1) {
+		c.ref(ref[1])
+	}
 }
 
 func (c *command) checkFlags() {
@@ -130,7 +402,6 @@ func (c *command) checkFlags() {
 			if !strings.HasPrefix(c.tokens[i], "-") {
 				c.tokens = c.tokens[i:]
 				c.original = shellquote.Join(c.tokens...)
-				c.template = c.original
 				break
 			}
 			switch c.tokens[i] {
@@ -142,6 +413,74 @@ func (c *command) checkFlags() {
 				os.Exit(0)
 			case "-t", "--test":
 				dryRun = true
+			case "-j", "--jobs":
+				jobs = c.intFlag(&i)
+			case "--fail-fast":
+				maxFailures = 1
+			case "--max-failures":
+				maxFailures = c.intFlag(&i)
+			case "--retries":
+				retries = c.intFlag(&i)
+			case "--retry-delay":
+				retryDelay = c.durationFlag(&i)
+			case "--backoff":
+				switch b := c.flagValue(&i); b {
+				case "fixed":
+					exponential = false
+				case "exponential":
+					exponential = true
+				default:
+					fmt.Fprintf(os.Stderr, "Flag --backoff expects fixed or exponential, got %s\n", b)
+					os.Exit(2)
+				}
+			case "--jitter":
+				jitter = c.durationFlag(&i)
+			case "--timeout":
+				timeout = c.durationFlag(&i)
+			case "--kill-after":
+				killAfter = c.durationFlag(&i)
+			case "-s", "--summary":
+				summary = true
+			case "--failed-only":
+				summary = true
+				failedOnly = true
+			case "--json":
+				jsonDest = c.flagValue(&i)
+			case "--json-output":
+				jsonOutput = true
+			case "--state-file":
+				stateFile = c.flagValue(&i)
+			case "--resume":
+				resume = true
+			case "--rerun-failed":
+				rerunFailed = true
+			case "-p", "--prefix":
+				prefix = true
+			case "--prefix-format":
+				prefix = true
+				prefixFormat = c.flagValue(&i)
+			case "--link-mismatch":
+				linkMismatch = c.flagValue(&i)
+				if linkMismatch != "error" && linkMismatch != "pad" && linkMismatch != "truncate" {
+					fmt.Fprintf(os.Stderr, "Flag --link-mismatch expects error, pad or truncate, got %s\n", linkMismatch)
+					os.Exit(2)
+				}
+			case "--where":
+				wheres = append(wheres, c.flagValue(&i))
+			case "--hosts-only":
+				hostsOnly = true
+			case "--split-stdin":
+				splitStdin = c.flagValue(&i)
+				if !regexp.MustCompile(`^(round-robin|records|chunks:[1-9][0-9]*)$`).MatchString(splitStdin) {
+					fmt.Fprintf(os.Stderr, "Flag --split-stdin expects round-robin, chunks:N or records, got %s\n", splitStdin)
+					os.Exit(2)
+				}
+			case "--order":
+				order = c.flagValue(&i)
+				if order != "generated" && order != "completed" {
+					fmt.Fprintf(os.Stderr, "Flag --order expects generated or completed, got %s\n", order)
+					os.Exit(2)
+				}
 			default:
 				fmt.Fprintf(os.Stderr, "Flag not recognised (%s), try using lup -h to see the help\n", c.tokens[i])
 				os.Exit(2)
@@ -150,56 +489,37 @@ func (c *command) checkFlags() {
 	}
 }
 
-func (c *command) run() int {
-	var retcode int
-	var cmd *exec.Cmd
+// flagValue consumes and returns the value following the flag at position i
+func (c *command) flagValue(i *int) string {
+	flag := c.tokens[*i]
+	*i++
+	if *i >= len(c.tokens) {
+		fmt.Fprintf(os.Stderr, "Flag %s requires a value, try using lup -h to see the help\n", flag)
+		os.Exit(2)
+	}
+	return c.tokens[*i]
+}
 
-	for _, command := range c.commands {
-		switch shell {
-		case "powershell.exe":
-			command = "powershell -C " + strings.Replace(command, "\\!", "!", -1)
-			if input != "" {
-				command = shell + " -c \"Write-Host " + shellquote.Join(input) + " | " + command + "\""
-			}
-		case "cmd.exe":
-			//todo
-		default:
-			if input != "" {
-				command = shell + " -c \"echo " + shellquote.Join(input) + " | " + command + "\""
-			}
-		}
-		if shell == "powershell" {
-			if dryRun {
-				fmt.Println("powershell -Command", command)
-			} else {
-				cmd = exec.Command("powershell", "-Command", command)
-				cmd.Stdout, cmd.Stdin, cmd.Stderr = os.Stdout, os.Stdin, os.Stderr
-				if err := cmd.Run(); err != nil {
-					retcode = 1
-				}
-			}
-		} else {
-			t, err := shellquote.Split(command)
-			if err != nil {
-				errOn(err, "Couldn't split command", 5)
-			}
-			if dryRun {
-				fmt.Println(command)
-			} else if len(t) > 0 {
-				if len(t) > 1 {
-					cmd = exec.Command(t[0], t[1:]...)
-				} else if len(t) == 1 {
-					cmd = exec.Command(t[0])
-				} else {
-					showHelp()
-					os.Exit(0)
-				}
-				cmd.Stdout, cmd.Stdin, cmd.Stderr = os.Stdout, os.Stdin, os.Stderr
-				if err := cmd.Run(); err != nil {
-					retcode = 1
-				}
-			}
-		}
+// intFlag consumes the value following the flag at position i, which
+// must be a positive integer
+func (c *command) intFlag(i *int) int {
+	flag := c.tokens[*i]
+	n, err := strconv.Atoi(c.flagValue(i))
+	if err != nil || n < 1 {
+		fmt.Fprintf(os.Stderr, "Flag %s expects a positive integer, got %s\n", flag, c.tokens[*i])
+		os.Exit(2)
+	}
+	return n
+}
+
+// durationFlag consumes the value following the flag at position i, which
+// must be a positive duration such as 500ms or 2m
+func (c *command) durationFlag(i *int) time.Duration {
+	flag := c.tokens[*i]
+	d, err := time.ParseDuration(c.flagValue(i))
+	if err != nil || d <= 0 {
+		fmt.Fprintf(os.Stderr, "Flag %s expects a positive duration (e.g. 500ms, 2m), got %s\n", flag, c.tokens[*i])
+		os.Exit(2)
 	}
-	return retcode
+	return d
 }
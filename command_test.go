@@ -1,37 +1,23 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
-var newGroupTests = []struct {
-	s  string
-	ep string
-	is state
-	id state
-	e  group
-	et []string
+var getGroupsTests = []struct {
+	s []string
+	e []string
 }{
 	{
-		s:  "hello,\\@well\\, goodbye\\@,farewell",
-		ep: "",
-		is: state{on: false},
-		id: state{on: false},
-		e: group{
-			hidden:       false,
-			externalPath: "",
-			terms: []string{
-				"hello",
-				"\\@well\\, goodbye\\@",
-				"farewell",
-			},
-		},
-		et: []string{
-			"hello",
-			"@well, goodbye@",
-			"farewell",
-		},
+		s: []string{"echo", "@hello,\\@well\\, goodbye\\@,farewell@"},
+		e: []string{"hello", "@well, goodbye@", "farewell"},
+	},
+	{
+		s: []string{"echo", "@-:hello,bonjour@"},
+		e: []string{"hello", "bonjour"},
 	},
 }
 
@@ -113,7 +99,7 @@ var getCommandsTests = []struct {
 		et: []string{"'echo '"},
 	},
 	{
-		s:  []string{"@hello,bonjour@,\\@well\\, goodbye\\@,farewell /usr/bin/ @files:/dev@files:*@"},
+		s:  []string{"@hello,bonjour@,\\@well\\, goodbye\\@,farewell /usr/bin/ @files:/dev@files:*\\@"},
 		ep: "",
 		is: state{on: false},
 		id: state{on: false},
@@ -144,15 +130,11 @@ func TestGetCommands(t *testing.T) {
 	}
 }
 
-func TestNewGroup(t *testing.T) {
-	for _, x := range newGroupTests {
-		r := newGroup(x.s, x.ep, x.is, x.id)
-		if x.ep == r.externalPath {
-			for j, o := range r.terms {
-				if o != x.et[j] {
-					t.Errorf("Failed TestNewGroup - expected %s, got %s", o, x.et[j])
-				}
-			}
+func TestGetGroups(t *testing.T) {
+	for _, x := range getGroupsTests {
+		c := newCommand(x.s...)
+		if len(c.groups) != 1 || strings.Join(c.groups[0].terms, "|") != strings.Join(x.e, "|") {
+			t.Errorf("Failed TestGetGroups on %s - expected terms %q, got %v", x.s, x.e, c.groups)
 		}
 	}
 }
@@ -186,6 +168,7 @@ var runTests = []struct {
 }
 
 func TestRun(t *testing.T) {
+	defer tempState()()
 	dryRun = false
 	for _, r := range runTests {
 		c := newCommand(r.s...)
@@ -197,3 +180,272 @@ func TestRun(t *testing.T) {
 		}
 	}
 }
+
+var tagTests = []struct {
+	s []string
+	e []string
+}{
+	{
+		s: []string{"echo", "@web01,web02@", "@prod@", "@1@"},
+		e: []string{"[web01 prod] ", "[web02 prod] "},
+	},
+	{
+		s: []string{"@-:a,b@", "echo", "@1@"},
+		e: []string{"[a] ", "[b] "},
+	},
+	{
+		s: []string{"--prefix-format", "@2@/@1@: ", "echo", "@a,b@", "@x@"},
+		e: []string{"x/a: ", "x/b: "},
+	},
+	{
+		s: []string{"--prefix-format", "@host@: ", "echo", "@-:host=a,b@", "@host@"},
+		e: []string{"a: ", "b: "},
+	},
+}
+
+func TestTag(t *testing.T) {
+	defer func() { prefix, prefixFormat = false, "" }()
+	for _, x := range tagTests {
+		prefixFormat = ""
+		c := newCommand(x.s...)
+		for i := range c.commands {
+			if r := c.tag(i); r != x.e[i] {
+				t.Errorf("Failed TestTag on %s - expected %q, got %q", x.s, x.e[i], r)
+			}
+		}
+	}
+}
+
+var nestedTests = []struct {
+	s []string
+	e []string
+}{
+	{
+		s: []string{"nslookup", "@microsoft.@com,net,org@,google.com@"},
+		e: []string{"nslookup microsoft.com", "nslookup microsoft.net", "nslookup microsoft.org", "nslookup google.com"},
+	},
+	{
+		s: []string{"echo", "@web@1..2@,db@", "@1@"},
+		e: []string{"echo web1 web1", "echo web2 web2", "echo db db"},
+	},
+	{
+		s: []string{"echo", "@a@b@c,d@,e@,f@"},
+		e: []string{"echo abc", "echo abd", "echo ae", "echo f"},
+	},
+	{
+		s: []string{"echo", "@x@-:1,2@,y@"},
+		e: []string{"echo x", "echo x", "echo y"},
+	},
+	{
+		s: []string{"echo", "@dev,test@_@1..2@"},
+		e: []string{"echo dev_1", "echo dev_2", "echo test_1", "echo test_2"},
+	},
+	{
+		s: []string{"echo", "@9..8@@0..1@"},
+		e: []string{"echo 90", "echo 91", "echo 80", "echo 81"},
+	},
+	{
+		s: []string{"echo", "@dev,prod@-@us,eu@-@1..3@"},
+		e: []string{"echo dev-us-1", "echo dev-us-2", "echo dev-us-3", "echo dev-eu-1", "echo dev-eu-2", "echo dev-eu-3",
+			"echo prod-us-1", "echo prod-us-2", "echo prod-us-3", "echo prod-eu-1", "echo prod-eu-2", "echo prod-eu-3"},
+	},
+	{
+		s: []string{"echo", "@a,b@_@c,d@_@e,f@"},
+		e: []string{"echo a_c_e", "echo a_c_f", "echo a_d_e", "echo a_d_f", "echo b_c_e", "echo b_c_f", "echo b_d_e", "echo b_d_f"},
+	},
+	{
+		s: []string{"echo", "s3://@a,b@/@c,d@/@e,f@"},
+		e: []string{"echo s3://a/c/e", "echo s3://a/c/f", "echo s3://a/d/e", "echo s3://a/d/f",
+			"echo s3://b/c/e", "echo s3://b/c/f", "echo s3://b/d/e", "echo s3://b/d/f"},
+	},
+	{
+		s: []string{"echo", "@x@1,2@,y@-@a,b@"},
+		e: []string{"echo x1-a", "echo x1-b", "echo x2-a", "echo x2-b", "echo y-a", "echo y-b"},
+	},
+}
+
+var namedTests = []struct {
+	s []string
+	e []string
+}{
+	{
+		s: []string{"echo", "@host=web1,web2@", "@env=prod@", "@host@.@env@"},
+		e: []string{"echo web1 prod web1.prod", "echo web2 prod web2.prod"},
+	},
+	{
+		s: []string{"@-:f=a.jpg,b.jpg@", "convert", "@f@", "@f|noext@.png", "@1@"},
+		e: []string{" convert a.jpg a.png a.jpg", " convert b.jpg b.png b.jpg"},
+	},
+	{
+		s: []string{"echo", "@prod@", "@1,2@"},
+		e: []string{"echo prod 1", "echo prod 2"},
+	},
+}
+
+var fieldTests = []struct {
+	s []string
+	e []string
+}{
+	{
+		s: []string{"ssh", "@csv:/tmp/luptests/fields.csv@", "--ip", "@1.ip@", "@1.role|upper@"},
+		e: []string{"ssh web1 --ip 10.0.0.1 WEB", "ssh db1 --ip 10.0.0.2 DB"},
+	},
+	{
+		s: []string{"echo", "@-:h=csv:/tmp/luptests/fields.csv@", "@env=dev,prod@", "@h.2@-@env@"},
+		e: []string{"echo  dev 10.0.0.1-dev", "echo  prod 10.0.0.1-prod", "echo  dev 10.0.0.2-dev", "echo  prod 10.0.0.2-prod"},
+	},
+	{
+		s: []string{"ping", "@csv:/tmp/luptests/fields.csv@", "@=:a,b@", "@1.ip@"},
+		e: []string{"ping web1 a 10.0.0.1", "ping db1 b 10.0.0.2"},
+	},
+	{
+		s: []string{"echo", "@1,2@", "@1.5@"},
+		e: []string{"echo 1 1.5", "echo 2 1.5"},
+	},
+}
+
+func TestFieldBackrefs(t *testing.T) {
+	if err := ioutil.WriteFile("/tmp/luptests/fields.csv", []byte("name,ip,role\nweb1,10.0.0.1,web\ndb1,10.0.0.2,db\n"), 0700); err != nil {
+		t.Fatalf("Failed to write fields.csv in TestFieldBackrefs")
+	}
+	for _, x := range fieldTests {
+		c := newCommand(x.s...)
+		if len(c.commands) != len(x.e) {
+			t.Errorf("Failed TestFieldBackrefs on %s - expected %d commands, got %s", x.s, len(x.e), c.commands)
+			continue
+		}
+		for i, y := range c.commands {
+			if y != x.e[i] {
+				t.Errorf("Failed TestFieldBackrefs on %s - expected %s, got %s", x.s, x.e[i], y)
+			}
+		}
+	}
+}
+
+func TestNamedGroups(t *testing.T) {
+	for _, x := range namedTests {
+		c := newCommand(x.s...)
+		if len(c.commands) != len(x.e) {
+			t.Errorf("Failed TestNamedGroups on %s - expected %d commands, got %s", x.s, len(x.e), c.commands)
+			continue
+		}
+		for i, y := range c.commands {
+			if y != x.e[i] {
+				t.Errorf("Failed TestNamedGroups on %s - expected %s, got %s", x.s, x.e[i], y)
+			}
+		}
+	}
+}
+
+var whereTests = []struct {
+	w []string
+	s []string
+	e []string
+}{
+	{
+		w: []string{"env != prod || mode != debug"},
+		s: []string{"deploy", "@env=dev,prod@", "@mode=release,debug@"},
+		e: []string{"deploy dev release", "deploy dev debug", "deploy prod release"},
+	},
+	{
+		w: []string{"1 >= 3", "1 < 5"},
+		s: []string{"echo", "@1..9@"},
+		e: []string{"echo 3", "echo 4"},
+	},
+	{
+		s: []string{"echo", "@host=web1,db1,web2@", "@?host =~ ^web@", "x"},
+		e: []string{"echo web1  x", "echo web2  x"},
+	},
+	{
+		w: []string{"src != @dst@"},
+		s: []string{"cp", "@src=a,b@", "@dst=a,b@"},
+		e: []string{"cp a b", "cp b a"},
+	},
+}
+
+func TestWhere(t *testing.T) {
+	defer func() { wheres = nil }()
+	for _, x := range whereTests {
+		wheres = x.w
+		c := newCommand(x.s...)
+		if len(c.commands) != len(x.e) {
+			t.Errorf("Failed TestWhere on %s - expected %d commands, got %s", x.s, len(x.e), c.commands)
+			continue
+		}
+		for i, y := range c.commands {
+			if y != x.e[i] {
+				t.Errorf("Failed TestWhere on %s - expected %q, got %q", x.s, x.e[i], y)
+			}
+		}
+	}
+}
+
+func TestNestedGroups(t *testing.T) {
+	for _, x := range nestedTests {
+		c := newCommand(x.s...)
+		if len(c.commands) != len(x.e) {
+			t.Errorf("Failed TestNestedGroups on %s - expected %d commands, got %s", x.s, len(x.e), c.commands)
+			continue
+		}
+		for i, y := range c.commands {
+			if y != x.e[i] {
+				t.Errorf("Failed TestNestedGroups on %s - expected %s, got %s", x.s, x.e[i], y)
+			}
+		}
+	}
+}
+
+var linkTests = []struct {
+	s []string
+	m string
+	e []string
+}{
+	{
+		s: []string{"echo", "@web1,web2@", "@=:10.0.0.1,10.0.0.2@", "@a,b@"},
+		m: "error",
+		e: []string{"echo web1 10.0.0.1 a", "echo web1 10.0.0.1 b", "echo web2 10.0.0.2 a", "echo web2 10.0.0.2 b"},
+	},
+	{
+		s: []string{"echo", "@1..3@", "@-:=:a,b,c@", "@2@"},
+		m: "error",
+		e: []string{"echo 1  a", "echo 2  b", "echo 3  c"},
+	},
+	{
+		s: []string{"echo", "@a,b,c@", "@=:1,2@", "@=:x@"},
+		m: "pad",
+		e: []string{"echo a 1 x", "echo b 2 ", "echo c  "},
+	},
+	{
+		s: []string{"echo", "@a,b,c@", "@=:1,2@"},
+		m: "truncate",
+		e: []string{"echo a 1", "echo b 2"},
+	},
+}
+
+func TestLinkedGroups(t *testing.T) {
+	defer func() { linkMismatch = "error" }()
+	for _, x := range linkTests {
+		linkMismatch = x.m
+		c := newCommand(x.s...)
+		if len(c.commands) != len(x.e) {
+			t.Errorf("Failed TestLinkedGroups on %s - expected %d commands, got %s", x.s, len(x.e), c.commands)
+			continue
+		}
+		for i, y := range c.commands {
+			if y != x.e[i] {
+				t.Errorf("Failed TestLinkedGroups on %s - expected %s, got %s", x.s, x.e[i], y)
+			}
+		}
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	var c command
+	if err := c.link(&group{terms: []string{"a"}}); err == nil {
+		t.Errorf("Failed TestLinkErrors - expected an error linking the first group")
+	}
+	c.groups = []group{{terms: []string{"a", "b"}}}
+	if err := c.link(&group{terms: []string{"1"}, linked: true}); err == nil {
+		t.Errorf("Failed TestLinkErrors - expected an error linking groups of different lengths")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// condition compares the term used from a group with a value, or with the
+// term used from another group if the value is a backref
+type condition struct {
+	ref   string
+	group int
+	op    string
+	value string
+	// other is the group the value refers to, from 0, or -1
+	other int
+	re    *regexp.Regexp
+}
+
+// rule is a set of conditions which a combination of terms must meet to
+// become a command, given by --where or inline as @?...@. Conditions are
+// joined by && and ||, with && binding more tightly
+type rule struct {
+	text string
+	any  [][]*condition
+	// last is the highest group, from 0, the conditions refer to, which
+	// is the first point at which the rule can be checked
+	last int
+}
+
+var valueRef = regexp.MustCompile(`^@(\w+)@$`)
+
+var conditionParts = regexp.MustCompile(`^\s*@?(\w+)@?\s*(==|!=|=~|!~|<=|>=|<|>|=)\s*(.*?)\s*$`)
+
+// parseRule reads conditions such as env != prod && n >= 10, where the left
+// of each is a group's number or name, which can be written as a backref,
+// and the right a value or a backref
+func parseRule(text string) (*rule, error) {
+	r := &rule{text: text}
+	for _, alternative := range strings.Split(text, "||") {
+		var all []*condition
+		for _, part := range strings.Split(alternative, "&&") {
+			x := conditionParts.FindStringSubmatch(part)
+			if x == nil {
+				return nil, fmt.Errorf("Couldn't read condition %q, expected e.g. env != prod, host =~ ^web or n >= 10", strings.TrimSpace(part))
+			}
+			c := &condition{ref: x[1], op: x[2], value: x[3], other: -1}
+			if c.op == "=~" || c.op == "!~" {
+				re, err := regexp.Compile(c.value)
+				if err != nil {
+					return nil, fmt.Errorf("Condition %q has an invalid regex (%s)", strings.TrimSpace(part), err)
+				}
+				c.re = re
+			}
+			all = append(all, c)
+		}
+		r.any = append(r.any, all)
+	}
+	return r, nil
+}
+
+// resolve works out which group each condition refers to, from the group
+// numbers and names given
+func (r *rule) resolve(groups int, names map[string]int) error {
+	find := func(ref string) (int, error) {
+		n, ok := names[ref]
+		if !ok {
+			n, _ = strconv.Atoi(ref)
+		}
+		if n < 1 || n > groups {
+			return 0, fmt.Errorf("Condition refers to %s, which isn't a group", ref)
+		}
+		if n-1 > r.last {
+			r.last = n - 1
+		}
+		return n - 1, nil
+	}
+	var err error
+	for _, all := range r.any {
+		for _, c := range all {
+			if c.group, err = find(c.ref); err != nil {
+				return err
+			}
+			if x := valueRef.FindStringSubmatch(c.value); x != nil && c.re == nil {
+				if c.other, err = find(x[1]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// holds reports whether the terms chosen for each group meet the rule
+func (r *rule) holds(terms []string) bool {
+	for _, all := range r.any {
+		met := true
+		for _, c := range all {
+			value := c.value
+			if c.other > -1 {
+				value = terms[c.other]
+			}
+			met = met && c.holds(terms[c.group], value)
+		}
+		if met {
+			return true
+		}
+	}
+	return false
+}
+
+// holds reports whether term meets the condition when compared to value.
+// Numeric comparisons are never met by terms or values which aren't numbers
+func (c *condition) holds(term string, value string) bool {
+	switch c.op {
+	case "==", "=":
+		return term == value
+	case "!=":
+		return term != value
+	case "=~":
+		return c.re.MatchString(term)
+	case "!~":
+		return !c.re.MatchString(term)
+	}
+	a, err := strconv.ParseFloat(term, 64)
+	if err != nil {
+		return false
+	}
+	b, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	}
+	return a >= b
+}
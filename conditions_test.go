@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+var ruleTests = []struct {
+	s string
+	t []string
+	e bool
+}{
+	{"1 == prod", []string{"prod"}, true},
+	{"1 = prod", []string{"dev"}, false},
+	{"@1@ != prod", []string{"dev"}, true},
+	{"2 =~ ^web[0-9]+$", []string{"x", "web01"}, true},
+	{"2 !~ ^web", []string{"x", "web01"}, false},
+	{"1 > 9", []string{"10"}, true},
+	{"1 >= 10 && 1 <= 20", []string{"15"}, true},
+	{"1 < 2.5", []string{"2.25"}, true},
+	{"1 < 5", []string{"abc"}, false},
+	{"1 == prod && 2 == debug || 2 == release", []string{"prod", "release"}, true},
+	{"1 != prod || 2 != debug", []string{"prod", "debug"}, false},
+	{"1 != @2@", []string{"a", "a"}, false},
+	{"2 > @1@", []string{"5", "10"}, true},
+	{"1 =~ @2@", []string{"x", "x"}, false},
+}
+
+func TestRules(t *testing.T) {
+	for _, x := range ruleTests {
+		r, err := parseRule(x.s)
+		if err == nil {
+			err = r.resolve(len(x.t), map[string]int{})
+		}
+		if err != nil {
+			t.Errorf("Failed TestRules on %s - %s", x.s, err)
+			continue
+		}
+		if h := r.holds(x.t); h != x.e {
+			t.Errorf("Failed TestRules on %s with %s - expected %t, got %t", x.s, x.t, x.e, h)
+		}
+	}
+}
+
+func TestRuleErrors(t *testing.T) {
+	for _, s := range []string{"1", "1 ~ x", "1 =~ (", "&& 1 == 2"} {
+		if _, err := parseRule(s); err == nil {
+			t.Errorf("Failed TestRuleErrors - expected an error reading %s", s)
+		}
+	}
+	r, _ := parseRule("env == prod && 3 > 1")
+	if err := r.resolve(2, map[string]int{"env": 1}); err == nil {
+		t.Errorf("Failed TestRuleErrors - expected an error resolving a group which doesn't exist")
+	}
+	r, _ = parseRule("env == prod && 2 > 1")
+	if err := r.resolve(2, map[string]int{"env": 1}); err != nil || r.last != 1 {
+		t.Errorf("Failed TestRuleErrors - expected the rule to be checked from group 1, got %d (%v)", r.last, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dataKinds are the directives which read records from structured files,
+// each record becoming a term whose fields backrefs can pick out
+var dataKinds = []string{"csv", "tsv", "json"}
+
+func isData(kind string) bool {
+	for _, k := range dataKinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// readData reads the records from a csv, tsv or json directive's file,
+// returning the term used for each along with its fields
+func readData(kind string, arg string) (terms []string, fields []map[string]string) {
+	var err error
+	switch kind {
+	case "json":
+		terms, fields, err = readJSON(arg)
+	default:
+		comma := ','
+		if kind == "tsv" {
+			comma = '\t'
+		}
+		terms, fields, err = readCSV(arg, comma)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read %s:%s (%s)\n", kind, arg, err)
+		os.Exit(17)
+	}
+	return
+}
+
+// readCSV reads a file with a header row, naming each record's fields by
+// their column's header and by their column's number from 1. The term used
+// for each record is its first field
+func readCSV(path string, comma rune) (terms []string, fields []map[string]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil || len(rows) == 0 {
+		return nil, nil, err
+	}
+	header := rows[0]
+	for _, row := range rows[1:] {
+		record := map[string]string{}
+		for i, value := range row {
+			record[strconv.Itoa(i+1)] = value
+			if i < len(header) && header[i] != "" {
+				record[header[i]] = value
+			}
+		}
+		terms = append(terms, row[0])
+		fields = append(fields, record)
+	}
+	return
+}
+
+var jsonPath = regexp.MustCompile(`\.([^.\[]+)|\[([0-9]+|\*)\]`)
+
+// readJSON reads the values selected by the path following # in arg, e.g.
+// inventory.json#.hosts[*]. Paths are made of .key, [n] and [*] steps, and an
+// array at the end of the path is iterated through as if it ended in [*].
+// Objects are flattened, so nested fields are named like address.city. The
+// term used for each value is the value itself, or JSON for objects and arrays
+func readJSON(arg string) (terms []string, fields []map[string]string, err error) {
+	path, query := arg, ""
+	if i := strings.Index(arg, "#"); i > -1 {
+		path, query = arg[:i], arg[i+1:]
+	}
+	if query != "" && jsonPath.ReplaceAllString(query, "") != "" {
+		return nil, nil, fmt.Errorf("path %s should be made of .key, [n] and [*] steps, e.g. .hosts[*]", query)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var root interface{}
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, nil, err
+	}
+	values := []interface{}{root}
+	for _, step := range jsonPath.FindAllStringSubmatch(query, -1) {
+		var next []interface{}
+		for _, v := range values {
+			switch {
+			case step[1] != "":
+				if m, ok := v.(map[string]interface{}); ok {
+					if x, ok := m[step[1]]; ok {
+						next = append(next, x)
+					}
+				}
+			case step[2] == "*":
+				if a, ok := v.([]interface{}); ok {
+					next = append(next, a...)
+				}
+			default:
+				n, _ := strconv.Atoi(step[2])
+				if a, ok := v.([]interface{}); ok && n < len(a) {
+					next = append(next, a[n])
+				}
+			}
+		}
+		values = next
+	}
+	if len(values) == 1 {
+		if a, ok := values[0].([]interface{}); ok {
+			values = a
+		}
+	}
+	for _, v := range values {
+		record := map[string]string{}
+		flatten("", v, record)
+		terms = append(terms, jsonTerm(v))
+		fields = append(fields, record)
+	}
+	return
+}
+
+// flatten adds the fields of v to record, naming nested fields after the
+// path to them
+func flatten(name string, v interface{}, record map[string]string) {
+	join := func(key string) string {
+		if name == "" {
+			return key
+		}
+		return name + "." + key
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			flatten(join(k), x, record)
+		}
+	case []interface{}:
+		for i, x := range v {
+			flatten(join(strconv.Itoa(i)), x, record)
+		}
+	}
+	if name != "" {
+		record[name] = jsonTerm(v)
+	}
+}
+
+// jsonTerm writes a JSON value as a term, strings without their quotes
+func jsonTerm(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// hasField reports whether any of the records have the named field
+func hasField(fields []map[string]string, name string) bool {
+	for _, record := range fields {
+		if _, ok := record[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+var readDataTests = []struct {
+	kind  string
+	arg   string
+	e     []string
+	field string
+	ef    []string
+}{
+	{"csv", "/tmp/luptests/hosts.csv", []string{"web1", "db1"}, "ip", []string{"10.0.0.1", "10.0.0.2"}},
+	{"csv", "/tmp/luptests/hosts.csv", []string{"web1", "db1"}, "3", []string{"web", "db, primary"}},
+	{"tsv", "/tmp/luptests/hosts.tsv", []string{"web1", "db1"}, "role", []string{"web", "db"}},
+	{"json", "/tmp/luptests/hosts.json#.hosts", []string{`{"ip":"10.0.0.1","loc":{"dc":"lon"},"name":"web1"}`, `{"ip":"10.0.0.2","name":"db1","ports":[5432,5433]}`}, "loc.dc", []string{"lon", ""}},
+	{"json", "/tmp/luptests/hosts.json#.hosts[*].name", []string{"web1", "db1"}, "", nil},
+	{"json", "/tmp/luptests/hosts.json#.hosts[1].ports", []string{"5432", "5433"}, "", nil},
+	{"json", "/tmp/luptests/hosts.json#.hosts[0].loc", []string{`{"dc":"lon"}`}, "dc", []string{"lon"}},
+}
+
+func TestReadData(t *testing.T) {
+	files := map[string]string{
+		"hosts.csv":  "name,ip,role\nweb1,10.0.0.1,web\ndb1,10.0.0.2,\"db, primary\"\n",
+		"hosts.tsv":  "name\tip\trole\nweb1\t10.0.0.1\tweb\ndb1\t10.0.0.2\tdb\n",
+		"hosts.json": `{"hosts": [{"name": "web1", "ip": "10.0.0.1", "loc": {"dc": "lon"}}, {"name": "db1", "ip": "10.0.0.2", "ports": [5432, 5433]}]}`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile("/tmp/luptests/"+name, []byte(data), 0700); err != nil {
+			t.Fatalf("Failed to write %s in TestReadData", name)
+		}
+	}
+	for _, x := range readDataTests {
+		terms, fields := readData(x.kind, x.arg)
+		if len(terms) != len(x.e) || len(fields) != len(x.e) {
+			t.Errorf("Failed TestReadData on %s:%s - expected %s, got %s", x.kind, x.arg, x.e, terms)
+			continue
+		}
+		for i, term := range terms {
+			if term != x.e[i] {
+				t.Errorf("Failed TestReadData on %s:%s - expected %s, got %s", x.kind, x.arg, x.e[i], term)
+			}
+			if x.field != "" && fields[i][x.field] != x.ef[i] {
+				t.Errorf("Failed TestReadData on %s:%s - expected field %s to be %s, got %s", x.kind, x.arg, x.field, x.ef[i], fields[i][x.field])
+			}
+		}
+	}
+}
+
+func TestReadJSONErrors(t *testing.T) {
+	for _, arg := range []string{"/tmp/luptests/hosts.json#hosts", "/tmp/luptests/hosts.json#.hosts[-1]", "/tmp/luptests/missing.json"} {
+		if _, _, err := readJSON(arg); err == nil {
+			t.Errorf("Failed TestReadJSONErrors on %s - expected an error", arg)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayouts are the layouts the ends of a date range can be written in
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+// maxDates limits how many dates a single dates directive can expand to, so
+// that a small step over a long range doesn't try to run millions of commands
+const maxDates = 65536
+
+// expandDates expands dates directives such as dates:2026-01-01..2026-01-31,
+// which can be followed by a step (e.g. ..6h, ..1w or ..1mo, defaulting to a
+// day) and a layout, either strftime style (e.g. %Y%m%d) or a Go layout in
+// braces (e.g. %{Jan 2}). Without a layout, dates are written the same way as
+// the start of the range
+func expandDates(words []string) (expanded []string) {
+	re := regexp.MustCompile(`^dates:(.+?)\.\.(.+?)(?:\.\.([0-9][0-9a-z.]*))?(%.*)?$`)
+	for _, word := range words {
+		if !strings.HasPrefix(word, "dates:") {
+			continue
+		}
+		x := re.FindStringSubmatch(word)
+		if x == nil {
+			fmt.Fprintf(os.Stderr, "Date range %s should look like dates:2026-01-01..2026-01-31\n", word)
+			os.Exit(6)
+		}
+		first, layout := parseDate(x[1])
+		last, _ := parseDate(x[2])
+		step := x[3]
+		if step == "" {
+			step = "1d"
+		}
+		if first.Equal(last) {
+			fmt.Fprintf(os.Stderr, "Date range %s starts and ends on the same date.\n", word)
+			os.Exit(6)
+		}
+		nth := dateStep(step, last.Before(first))
+		if layout == dateLayouts[0] && nth(first, 1).Sub(first)%(24*time.Hour) != 0 {
+			layout = dateLayouts[1]
+		}
+		format := func(t time.Time) string {
+			return t.Format(layout)
+		}
+		if x[4] != "" {
+			format = dateFormat(x[4])
+		}
+		lo, hi := first, last
+		if last.Before(first) {
+			lo, hi = last, first
+		}
+		for k, t := 0, first; !t.Before(lo) && !t.After(hi); k, t = k+1, nth(first, k+1) {
+			if k == maxDates {
+				fmt.Fprintf(os.Stderr, "Date range %s holds more than %d dates.\n", word, maxDates)
+				os.Exit(6)
+			}
+			expanded = append(expanded, format(t))
+		}
+	}
+	if len(expanded) == 0 {
+		expanded = words
+	}
+	return
+}
+
+// parseDate reads one end of a date range, returning the layout it was
+// written in along with it
+func parseDate(s string) (time.Time, string) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, layout
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Couldn't read %s as a date, expected e.g. 2026-01-31, 2026-01-31T06:00 or an RFC 3339 timestamp.\n", s)
+	os.Exit(6)
+	return time.Time{}, ""
+}
+
+// dateStep returns a function moving a time on by k steps, or back by them
+// if backwards is set. Steps are a number followed by w, d, mo or y, or
+// anything time.ParseDuration understands. Each date is worked out from the
+// start of the range, and month and year steps stop at the end of shorter
+// months, so that the 31st of each month doesn't drift into the next
+func dateStep(step string, backwards bool) func(time.Time, int) time.Time {
+	var n int
+	var unit string
+	if x := regexp.MustCompile(`^([0-9]+)(y|mo|w|d)$`).FindStringSubmatch(step); x != nil {
+		n, _ = strconv.Atoi(x[1])
+		unit = x[2]
+	}
+	d, err := time.ParseDuration(step)
+	if unit == "" && err != nil {
+		fmt.Fprintf(os.Stderr, "Date range step %s isn't recognised, expected e.g. 1d, 6h, 1w or 1mo.\n", step)
+		os.Exit(6)
+	}
+	if n == 0 && d == 0 {
+		fmt.Fprintf(os.Stderr, "Date range step %s must be greater than 0.\n", step)
+		os.Exit(6)
+	}
+	if backwards {
+		n, d = -n, -d
+	}
+	switch unit {
+	case "y":
+		return func(t time.Time, k int) time.Time { return addMonths(t, 12*k*n) }
+	case "mo":
+		return func(t time.Time, k int) time.Time { return addMonths(t, k*n) }
+	case "w":
+		return func(t time.Time, k int) time.Time { return t.AddDate(0, 0, 7*k*n) }
+	case "d":
+		return func(t time.Time, k int) time.Time { return t.AddDate(0, 0, k*n) }
+	}
+	return func(t time.Time, k int) time.Time { return t.Add(time.Duration(k) * d) }
+}
+
+// addMonths moves t on by the given number of months, keeping to the last
+// day of the month it lands in rather than spilling over into the next
+func addMonths(t time.Time, months int) time.Time {
+	moved := t.AddDate(0, months, 0)
+	if moved.Day() != t.Day() {
+		moved = moved.AddDate(0, 0, -moved.Day())
+	}
+	return moved
+}
+
+// dateFormat returns a function writing times in the given layout, which
+// is either a Go layout in braces or strftime style
+func dateFormat(layout string) func(time.Time) string {
+	if strings.HasPrefix(layout, "%{") && strings.HasSuffix(layout, "}") {
+		return func(t time.Time) string {
+			return t.Format(layout[2 : len(layout)-1])
+		}
+	}
+	return func(t time.Time) string {
+		return strftime(t, layout)
+	}
+}
+
+// strftime writes t using the more common strftime conversions
+func strftime(t time.Time, layout string) string {
+	var b strings.Builder
+	for i := 0; i < len(layout); i++ {
+		if layout[i] != '%' || i == len(layout)-1 {
+			b.WriteByte(layout[i])
+			continue
+		}
+		i++
+		switch layout[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'e':
+			b.WriteString(t.Format("_2"))
+		case 'j':
+			b.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'I':
+			b.WriteString(t.Format("03"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'u':
+			b.WriteString(strconv.Itoa((int(t.Weekday())+6)%7 + 1))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(layout[i])
+		}
+	}
+	return b.String()
+}
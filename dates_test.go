@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var expandDatesTests = []struct {
+	s string
+	e []string
+}{
+	{"dates:2026-01-30..2026-02-02", []string{"2026-01-30", "2026-01-31", "2026-02-01", "2026-02-02"}},
+	{"dates:2026-01-03..2026-01-01", []string{"2026-01-03", "2026-01-02", "2026-01-01"}},
+	{"dates:2026-01-01..2026-01-02..12h", []string{"2026-01-01T00:00", "2026-01-01T12:00", "2026-01-02T00:00"}},
+	{"dates:2026-01-01..2026-01-20..1w%Y%m%d", []string{"20260101", "20260108", "20260115"}},
+	{"dates:2026-01-15..2026-04-15..1mo%b", []string{"Jan", "Feb", "Mar", "Apr"}},
+	{"dates:2026-01-01T23:00..2026-01-02T01:00..1h%H:%M", []string{"23:00", "00:00", "01:00"}},
+	{"dates:2026-01-01..2026-01-02%{Jan 2}", []string{"Jan 1", "Jan 2"}},
+	{"dates:2026-01-31..2026-05-31..1mo", []string{"2026-01-31", "2026-02-28", "2026-03-31", "2026-04-30", "2026-05-31"}},
+	{"dates:2024-02-29..2026-03-01..1y", []string{"2024-02-29", "2025-02-28", "2026-02-28"}},
+	{"dates:2026-05-31..2026-02-01..1mo", []string{"2026-05-31", "2026-04-30", "2026-03-31", "2026-02-28"}},
+	{"2026-01-01..2026-01-02", []string{"2026-01-01..2026-01-02"}},
+}
+
+func TestExpandDates(t *testing.T) {
+	for _, x := range expandDatesTests {
+		result := expandDates([]string{x.s})
+		if len(result) != len(x.e) {
+			t.Errorf("Failed TestExpandDates on %s - expected %s, got %s", x.s, x.e, result)
+			continue
+		}
+		for i, r := range result {
+			if r != x.e[i] {
+				t.Errorf("Failed TestExpandDates on %s - expected %s, got %s", x.s, x.e, result)
+				break
+			}
+		}
+	}
+}
+
+var strftimeTests = []struct {
+	s string
+	e string
+}{
+	{"%Y-%m-%d %H:%M:%S", "2026-03-09 07:05:02"},
+	{"%y%j %a %A %b %B", "26068 Mon Monday Mar March"},
+	{"%F %T %I%p %u", "2026-03-09 07:05:02 07AM 1"},
+	{"%e %s 100%% %q", " 9 1773039902 100% %q"},
+}
+
+func TestStrftime(t *testing.T) {
+	d := time.Date(2026, 3, 9, 7, 5, 2, 0, time.UTC)
+	for _, x := range strftimeTests {
+		if r := strftime(d, x.s); r != x.e {
+			t.Errorf("Failed TestStrftime on %s - expected %q, got %q", x.s, x.e, r)
+		}
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 func backref(s string, curTerms []string) string {
@@ -25,19 +29,26 @@ func backref(s string, curTerms []string) string {
 }
 
 func expand(s string, externalPath string, inSingles bool, inDoubles bool) (r []string) {
-	r = expandPaths(expandLines(expandRanges([]string{s})), externalPath)
+	r = expandPaths(expandCommands(expandLines(expandIPs(expandDates(expandRanges([]string{s}))))), externalPath)
 	for i := range r {
-		if !inSingles && !inDoubles {
-			r[i] = strings.Replace(r[i], "'", "\\'", -1)
-			r[i] = strings.Replace(r[i], "\"", "\\\"", -1)
-		}
-		if inSingles {
-			r[i] = strings.Replace(r[i], "'", "'\\''", -1)
-		}
+		r[i] = escapeQuotes(r[i], inSingles, inDoubles)
 	}
 	return
 }
 
+// escapeQuotes escapes any quotes in a term so it survives being dropped
+// into the command inside or outside of quotes
+func escapeQuotes(s string, inSingles bool, inDoubles bool) string {
+	if !inSingles && !inDoubles {
+		s = strings.Replace(s, "'", "\\'", -1)
+		s = strings.Replace(s, "\"", "\\\"", -1)
+	}
+	if inSingles {
+		s = strings.Replace(s, "'", "'\\''", -1)
+	}
+	return s
+}
+
 func expandLines(words []string) (expanded []string) {
 	for _, word := range words {
 		if strings.HasPrefix(word, "lines:") {
@@ -62,30 +73,68 @@ func expandLines(words []string) (expanded []string) {
 	return
 }
 
+// expandCommands expands cmd directives such as cmd:kubectl get ns -o name by
+// running the command through the shell, using each line of its output as a
+// term. Commands are run even on dry runs, as their output is needed to know
+// what to run
+func expandCommands(words []string) (expanded []string) {
+	var matched bool
+	for _, word := range words {
+		if !strings.HasPrefix(word, "cmd:") {
+			continue
+		}
+		matched = true
+		cmd := subshell(word[4:])
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Command %s failed, so its output couldn't be used (%s)\n", word[4:], err)
+			os.Exit(18)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			expanded = append(expanded, addSlashes(scanner.Text()))
+		}
+	}
+	if !matched {
+		expanded = words
+	}
+	return
+}
+
+// subshell returns an exec.Cmd running line through the shell, so that it
+// can use pipes and the like
+func subshell(line string) *exec.Cmd {
+	switch {
+	case strings.HasPrefix(shell, "powershell"):
+		return exec.Command("powershell", "-Command", line)
+	case runtime.GOOS == "windows":
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("sh", "-c", line)
+}
+
+// expandRanges expands numeric ranges such as 1..10, 10..0..2 or 1..255%02x,
+// stepping towards the end by the optional step and formatting each number
+// with the optional printf verb. Without a format, numbers are zero-padded to
+// the width of the bounds if either of them starts with a zero. Letter ranges
+// such as a..f, and ranges with a common prefix such as sda..sdf or
+// node-a1..node-a9, count in the same way
 func expandRanges(words []string) (expanded []string) {
+	numeric := regexp.MustCompile(`^(-?[0-9]+)\.\.(-?[0-9]+)(?:\.\.(-?[0-9]+))?(%.*)?$`)
+	prefixed := regexp.MustCompile(`^([\w.-]*?)([a-zA-Z]|[0-9]+)\.\.([\w.-]*?)([a-zA-Z]|[0-9]+)(?:\.\.(-?[0-9]+))?$`)
 	for _, word := range words {
-		re := regexp.MustCompile(`^([0-9]+)\.\.([0-9]+)`)
-		res := re.FindAllStringSubmatch(word, -1)
-		for m, x := range res {
-			if len(x) == 0 {
-				break
+		if x := numeric.FindStringSubmatch(word); x != nil {
+			expanded = append(expanded, numberRange(word, x[1], x[2], x[3], x[4])...)
+		} else if x := prefixed.FindStringSubmatch(word); x != nil && x[1] == x[3] {
+			var terms []string
+			if isDigits(x[2]) && isDigits(x[4]) {
+				terms = numberRange(word, x[2], x[4], x[5], "")
+			} else if !isDigits(x[2]) && !isDigits(x[4]) && unicode.IsUpper(rune(x[2][0])) == unicode.IsUpper(rune(x[4][0])) {
+				terms = letterRange(word, x[2][0], x[4][0], x[5])
 			}
-			first, _ := strconv.Atoi(res[m][1])
-			last, _ := strconv.Atoi(res[m][2])
-
-			if last < first {
-				for i := first; i >= last; i-- {
-					expanded = append(expanded, strconv.Itoa(i))
-				}
-			} else if first < last {
-				for i := first; i <= last; i++ {
-					expanded = append(expanded, strconv.Itoa(i))
-				}
-			} else {
-				if first == last {
-					fmt.Fprintf(os.Stderr, "Integer range starts and ends on the same number.")
-					os.Exit(6)
-				}
+			for _, t := range terms {
+				expanded = append(expanded, x[1]+t)
 			}
 		}
 	}
@@ -95,6 +144,96 @@ func expandRanges(words []string) (expanded []string) {
 	return
 }
 
+// numberRange counts from first to last, given as written in the range
+func numberRange(word string, first string, last string, step string, format string) (terms []string) {
+	from, _ := strconv.Atoi(first)
+	to, _ := strconv.Atoi(last)
+	by := rangeStep(word, step)
+	write := func(i int) string {
+		return fmt.Sprintf(format, i)
+	}
+	if format == "" {
+		format = "%d"
+		if padded(first) || padded(last) {
+			// pad the digits to the same width, leaving any sign outside it
+			width := len(strings.TrimPrefix(first, "-"))
+			if w := len(strings.TrimPrefix(last, "-")); w > width {
+				width = w
+			}
+			write = func(i int) string {
+				if i < 0 {
+					return fmt.Sprintf("-%0*d", width, -i)
+				}
+				return fmt.Sprintf("%0*d", width, i)
+			}
+		}
+	}
+	switch {
+	case from == to:
+		fmt.Fprintf(os.Stderr, "Integer range starts and ends on the same number.")
+		os.Exit(6)
+	case !regexp.MustCompile(`^%[-+ #0]*[0-9]*[dboxX]$`).MatchString(format):
+		fmt.Fprintf(os.Stderr, "Integer range %s has an invalid format, expected a verb such as %%d, %%03d or %%x.\n", word)
+		os.Exit(6)
+	case to < from:
+		for i := from; i >= to; i -= by {
+			terms = append(terms, write(i))
+		}
+	default:
+		for i := from; i <= to; i += by {
+			terms = append(terms, write(i))
+		}
+	}
+	return
+}
+
+// letterRange counts from the letter first to last
+func letterRange(word string, first byte, last byte, step string) (terms []string) {
+	by := rangeStep(word, step)
+	switch {
+	case first == last:
+		fmt.Fprintf(os.Stderr, "Letter range %s starts and ends on the same letter.\n", word)
+		os.Exit(6)
+	case last < first:
+		for c := int(first); c >= int(last); c -= by {
+			terms = append(terms, string(rune(c)))
+		}
+	default:
+		for c := int(first); c <= int(last); c += by {
+			terms = append(terms, string(rune(c)))
+		}
+	}
+	return
+}
+
+// rangeStep reads a range's step, which defaults to 1 and always counts
+// towards the end of the range whatever its sign
+func rangeStep(word string, step string) int {
+	if step == "" {
+		return 1
+	}
+	n, _ := strconv.Atoi(step)
+	if n < 0 {
+		n = -n
+	}
+	if n == 0 {
+		fmt.Fprintf(os.Stderr, "Range %s has a step of 0.\n", word)
+		os.Exit(6)
+	}
+	return n
+}
+
+// isDigits reports whether s is made up only of digits
+func isDigits(s string) bool {
+	return regexp.MustCompile(`^[0-9]+$`).MatchString(s)
+}
+
+// padded reports whether a range bound is written with a leading zero
+func padded(bound string) bool {
+	bound = strings.TrimPrefix(bound, "-")
+	return len(bound) > 1 && bound[0] == '0'
+}
+
 func expandPaths(words []string, externalPath string) (s []string) {
 	var done bool
 	for _, word := range words {
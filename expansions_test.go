@@ -28,6 +28,25 @@ var expandRangesTests = []struct {
 	{"1..5", []string{"1", "2", "3", "4", "5"}},
 	{"5..1", []string{"5", "4", "3", "2", "1"}},
 	{"abc", []string{"abc"}},
+	{"01..10", []string{"01", "02", "03", "04", "05", "06", "07", "08", "09", "10"}},
+	{"0..100..25", []string{"0", "25", "50", "75", "100"}},
+	{"10..1..-4", []string{"10", "6", "2"}},
+	{"-2..1", []string{"-2", "-1", "0", "1"}},
+	{"-01..01", []string{"-01", "00", "01"}},
+	{"-05..05..5", []string{"-05", "00", "05"}},
+	{"-10..-08", []string{"-10", "-09", "-08"}},
+	{"8..11%x", []string{"8", "9", "a", "b"}},
+	{"0..16..8%#x", []string{"0x0", "0x8", "0x10"}},
+	{"1..3%03o", []string{"001", "002", "003"}},
+	{"1..5abc", []string{"1..5abc"}},
+	{"a..d", []string{"a", "b", "c", "d"}},
+	{"Z..X", []string{"Z", "Y", "X"}},
+	{"a..z..10", []string{"a", "k", "u"}},
+	{"sda..sdc", []string{"sda", "sdb", "sdc"}},
+	{"node-a9..node-a11", []string{"node-a9", "node-a10", "node-a11"}},
+	{"rack08..rack10", []string{"rack08", "rack09", "rack10"}},
+	{"main..feature", []string{"main..feature"}},
+	{"a..Z", []string{"a..Z"}},
 }
 
 var expandPathsTests = []struct {
@@ -81,6 +100,31 @@ func TestExpandLines(t *testing.T) {
 	}
 }
 
+var expandCommandsTests = []struct {
+	s string
+	e []string
+}{
+	{"cmd:printf 'web1\\nd@b,1\\n'", []string{"web1", "d\\@b\\,1"}},
+	{"cmd:printf 'a b\\nc\\n' | grep -v c", []string{"a b"}},
+	{"cmd:true", nil},
+	{"ls", []string{"ls"}},
+}
+
+func TestExpandCommands(t *testing.T) {
+	for _, x := range expandCommandsTests {
+		result := expandCommands([]string{x.s})
+		if len(result) != len(x.e) {
+			t.Errorf("Failed expandCommands - expected: %s, got %s", x.e, result)
+			continue
+		}
+		for i, r := range result {
+			if x.e[i] != r {
+				t.Errorf("Failed expandCommands - expected: %s, got %s", x.e, result)
+			}
+		}
+	}
+}
+
 func TestExpandRanges(t *testing.T) {
 	for _, x := range expandRangesTests {
 		result := expandRanges([]string{x.s})
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// filter transforms each term of a group, or the term a backref refers to
+type filter struct {
+	name string
+	from string
+	to   string
+	re   *regexp.Regexp
+}
+
+// filterNames lists the filters available, those ending in a colon take
+// two arguments, e.g. replace:foo:bar
+var filterNames = []string{"upper", "lower", "trim", "basename", "dirname", "ext", "noext", "replace:", "sub:"}
+
+// isFilter reports whether spec starts with the name of a filter. Filters
+// without arguments must be the whole of spec
+func isFilter(spec string) bool {
+	for _, name := range filterNames {
+		if spec == name || strings.HasSuffix(name, ":") && strings.HasPrefix(spec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newFilter reads a filter such as upper or replace:foo:bar
+func newFilter(spec string) (f filter, err error) {
+	parts := strings.SplitN(spec, ":", 3)
+	f.name = parts[0]
+	switch {
+	case !isFilter(spec):
+		return f, fmt.Errorf("Unknown filter %s", spec)
+	case f.name != "replace" && f.name != "sub":
+		return f, nil
+	case len(parts) != 3:
+		return f, fmt.Errorf("Filter %s expects two arguments, e.g. %s:from:to", spec, f.name)
+	}
+	f.from, f.to = parts[1], parts[2]
+	if f.name == "sub" {
+		if f.re, err = regexp.Compile(f.from); err != nil {
+			return f, fmt.Errorf("Filter %s has an invalid regex (%s)", spec, err)
+		}
+	}
+	return f, nil
+}
+
+func (f filter) apply(term string) string {
+	switch f.name {
+	case "upper":
+		return strings.ToUpper(term)
+	case "lower":
+		return strings.ToLower(term)
+	case "trim":
+		return strings.TrimSpace(term)
+	case "basename":
+		return filepath.Base(term)
+	case "dirname":
+		return filepath.Dir(term)
+	case "ext":
+		return strings.TrimPrefix(filepath.Ext(term), ".")
+	case "noext":
+		return strings.TrimSuffix(term, filepath.Ext(term))
+	case "replace":
+		return strings.Replace(term, f.from, f.to, -1)
+	case "sub":
+		return f.re.ReplaceAllString(term, f.to)
+	}
+	return term
+}
+
+// applyFilters runs term through each of the filters in turn
+func applyFilters(term string, filters []filter) string {
+	for _, f := range filters {
+		term = f.apply(term)
+	}
+	return term
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+var filterTests = []struct {
+	f string
+	s string
+	e string
+}{
+	{"upper", "web01", "WEB01"},
+	{"lower", "WEB01", "web01"},
+	{"trim", "  a b ", "a b"},
+	{"basename", "/srv/www/index.html", "index.html"},
+	{"dirname", "/srv/www/index.html", "/srv/www"},
+	{"dirname", "index.html", "."},
+	{"ext", "photo.tar.gz", "gz"},
+	{"ext", "README", ""},
+	{"noext", "photos/beach.jpg", "photos/beach"},
+	{"replace:o:0", "foo", "f00"},
+	{"replace:o:a:b", "foo", "fa:ba:b"},
+	{"sub:^(\\w+)\\.jpg$:thumb_${1}.png", "beach.jpg", "thumb_beach.png"},
+	{"sub:[0-9]+:", "web01", "web"},
+}
+
+func TestFilters(t *testing.T) {
+	for _, x := range filterTests {
+		f, err := newFilter(x.f)
+		if err != nil {
+			t.Errorf("Failed TestFilters on %s - %s", x.f, err)
+			continue
+		}
+		if r := f.apply(x.s); r != x.e {
+			t.Errorf("Failed TestFilters on %s - expected %s, got %s", x.f, x.e, r)
+		}
+	}
+}
+
+var filterErrorTests = []string{"bogus", "upperx", "replace:a", "sub:(:x"}
+
+func TestFilterErrors(t *testing.T) {
+	for _, x := range filterErrorTests {
+		if _, err := newFilter(x); err == nil {
+			t.Errorf("Failed TestFilterErrors - expected an error from %s", x)
+		}
+	}
+}
+
+var filterCommandTests = []struct {
+	s []string
+	e []string
+}{
+	{
+		s: []string{"echo", "@web1,db1@", "@1|upper@"},
+		e: []string{"echo web1 WEB1", "echo db1 DB1"},
+	},
+	{
+		s: []string{"convert", "@-:a.jpg,b.jpg@", "@1@", "@1|noext@.png"},
+		e: []string{"convert  a.jpg a.png", "convert  b.jpg b.png"},
+	},
+	{
+		s: []string{"echo", "@/a/b.txt,/c/d.txt|basename|replace:.txt:@"},
+		e: []string{"echo b", "echo d"},
+	},
+}
+
+func TestFilterCommands(t *testing.T) {
+	for _, x := range filterCommandTests {
+		c := newCommand(x.s...)
+		if len(c.commands) != len(x.e) {
+			t.Errorf("Failed TestFilterCommands on %s - expected %d commands, got %s", x.s, len(x.e), c.commands)
+			continue
+		}
+		for i, y := range c.commands {
+			if y != x.e[i] {
+				t.Errorf("Failed TestFilterCommands on %s - expected %s, got %s", x.s, x.e[i], y)
+			}
+		}
+	}
+}
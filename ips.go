@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// maxAddresses limits how many addresses a single cidr or ip directive can
+// expand to, so that a mistyped IPv6 prefix doesn't try to run billions of
+// commands
+const maxAddresses = 65536
+
+// expandIPs expands cidr directives such as cidr:10.0.0.0/28 into every
+// address in the block, and ip directives such as ip:10.0.0.5..10.0.0.20
+// into every address from the first to the last. Both IPv4 and IPv6 are
+// understood. With hostsOnly set, cidr blocks leave out their network
+// address and, for IPv4, their broadcast address
+func expandIPs(words []string) (expanded []string) {
+	for _, word := range words {
+		switch {
+		case strings.HasPrefix(word, "cidr:"):
+			expanded = append(expanded, cidrRange(word, word[5:])...)
+		case strings.HasPrefix(word, "ip:"):
+			expanded = append(expanded, ipRange(word, word[3:])...)
+		}
+	}
+	if len(expanded) == 0 {
+		expanded = words
+	}
+	return
+}
+
+func cidrRange(word string, block string) []string {
+	_, network, err := net.ParseCIDR(block)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read %s as a CIDR block, expected e.g. 10.0.0.0/24 or fd00::/120.\n", block)
+		os.Exit(6)
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones > 16 {
+		fmt.Fprintf(os.Stderr, "CIDR block %s holds more than %d addresses.\n", block, maxAddresses)
+		os.Exit(6)
+	}
+	first, last := ipFamily(network.IP), ipFamily(network.IP)
+	for i := range last {
+		last[i] |= ^network.Mask[i]
+	}
+	if hostsOnly && bits-ones > 1 {
+		first = nextIP(first, 1)
+		if bits == 32 {
+			last = nextIP(last, -1)
+		}
+	}
+	return addresses(word, first, last)
+}
+
+func ipRange(word string, ips string) []string {
+	ends := strings.Split(ips, "..")
+	if len(ends) != 2 || net.ParseIP(ends[0]) == nil || net.ParseIP(ends[1]) == nil {
+		fmt.Fprintf(os.Stderr, "IP range %s should look like ip:10.0.0.5..10.0.0.20\n", word)
+		os.Exit(6)
+	}
+	first, last := ipFamily(net.ParseIP(ends[0])), ipFamily(net.ParseIP(ends[1]))
+	switch {
+	case len(first) != len(last):
+		fmt.Fprintf(os.Stderr, "IP range %s mixes IPv4 and IPv6 addresses.\n", word)
+		os.Exit(6)
+	case first.Equal(last):
+		fmt.Fprintf(os.Stderr, "IP range %s starts and ends on the same address.\n", word)
+		os.Exit(6)
+	}
+	return addresses(word, first, last)
+}
+
+// addresses lists every address from first to last, counting down if last
+// comes before first
+func addresses(word string, first net.IP, last net.IP) (s []string) {
+	step := 1
+	if bytes.Compare(last, first) < 0 {
+		step = -1
+	}
+	for ip := first; ; ip = nextIP(ip, step) {
+		if len(s) == maxAddresses {
+			fmt.Fprintf(os.Stderr, "%s holds more than %d addresses.\n", word, maxAddresses)
+			os.Exit(6)
+		}
+		s = append(s, ip.String())
+		if ip.Equal(last) {
+			return
+		}
+	}
+}
+
+// ipFamily returns a copy of ip, 4 bytes long for IPv4 addresses
+func ipFamily(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return append(net.IP{}, ip...)
+}
+
+// nextIP returns the address after ip, or before it if step is negative
+func nextIP(ip net.IP, step int) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i] += byte(step)
+		if step > 0 && next[i] != 0 || step < 0 && next[i] != 0xff {
+			break
+		}
+	}
+	return next
+}
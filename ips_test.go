@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+var expandIPsTests = []struct {
+	s string
+	h bool
+	e []string
+}{
+	{"cidr:10.0.0.0/30", false, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	{"cidr:10.0.0.0/29", true, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+	{"cidr:10.0.0.7/31", true, []string{"10.0.0.6", "10.0.0.7"}},
+	{"cidr:fd00::/126", false, []string{"fd00::", "fd00::1", "fd00::2", "fd00::3"}},
+	{"cidr:fd00::/126", true, []string{"fd00::1", "fd00::2", "fd00::3"}},
+	{"ip:10.0.0.254..10.0.1.1", false, []string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"}},
+	{"ip:10.0.1.0..10.0.0.254", false, []string{"10.0.1.0", "10.0.0.255", "10.0.0.254"}},
+	{"ip:fe80::ffff..fe80::1:1", false, []string{"fe80::ffff", "fe80::1:0", "fe80::1:1"}},
+	{"10.0.0.0/30", false, []string{"10.0.0.0/30"}},
+}
+
+func TestExpandIPs(t *testing.T) {
+	defer func() { hostsOnly = false }()
+	for _, x := range expandIPsTests {
+		hostsOnly = x.h
+		result := expandIPs([]string{x.s})
+		if len(result) != len(x.e) {
+			t.Errorf("Failed TestExpandIPs on %s - expected %s, got %s", x.s, x.e, result)
+			continue
+		}
+		for i, r := range result {
+			if r != x.e[i] {
+				t.Errorf("Failed TestExpandIPs on %s - expected %s, got %s", x.s, x.e, result)
+				break
+			}
+		}
+	}
+}
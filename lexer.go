@@ -0,0 +1,62 @@
+package main
+
+type tokenKind int
+
+const (
+	tokText tokenKind = iota
+	// tokAt is an unescaped delimiter, opening or closing a group
+	tokAt
+	// tokComma is an unescaped comma, separating terms inside a group
+	tokComma
+	// tokPipe is a pipe, which inside a group starts its filters if one
+	// follows it
+	tokPipe
+)
+
+// token is a run of the command line, text tokens keep their escapes so
+// that the parser can pass terms on to expand untouched
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex splits a command line into delimiters, commas, pipes and the text
+// between them. A backslash escapes the first character after it which isn't
+// also a backslash, as shellquote doubles up any backslashes it is given. As
+// shellquote also escapes pipes with a single backslash, a pipe only counts as
+// escaped when it follows more than one
+func lex(src string) (tokens []token) {
+	var run int
+	start := 0
+	flush := func(end int) {
+		if end > start {
+			tokens = append(tokens, token{kind: tokText, text: src[start:end], pos: start})
+		}
+	}
+	for i, char := range src {
+		if char == '\\' {
+			run++
+			continue
+		}
+		escaped := run > 0
+		switch {
+		case char == '|' && run < 2:
+			flush(i - run)
+			tokens = append(tokens, token{kind: tokPipe, text: src[i-run : i+1], pos: i})
+			start = i + 1
+		case escaped:
+		case char == delimiter:
+			flush(i)
+			tokens = append(tokens, token{kind: tokAt, text: string(char), pos: i})
+			start = i + 1
+		case char == ',':
+			flush(i)
+			tokens = append(tokens, token{kind: tokComma, text: string(char), pos: i})
+			start = i + 1
+		}
+		run = 0
+	}
+	flush(len(src))
+	return
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+var lexTests = []struct {
+	s string
+	e []token
+}{
+	{
+		s: "echo @a,b@",
+		e: []token{
+			{kind: tokText, text: "echo ", pos: 0},
+			{kind: tokAt, text: "@", pos: 5},
+			{kind: tokText, text: "a", pos: 6},
+			{kind: tokComma, text: ",", pos: 7},
+			{kind: tokText, text: "b", pos: 8},
+			{kind: tokAt, text: "@", pos: 9},
+		},
+	},
+	{
+		s: "user\\@domain @x\\,y@",
+		e: []token{
+			{kind: tokText, text: "user\\@domain ", pos: 0},
+			{kind: tokAt, text: "@", pos: 13},
+			{kind: tokText, text: "x\\,y", pos: 14},
+			{kind: tokAt, text: "@", pos: 18},
+		},
+	},
+	{
+		s: "@1\\|upper@ 'a|b' c\\\\\\|d",
+		e: []token{
+			{kind: tokAt, text: "@", pos: 0},
+			{kind: tokText, text: "1", pos: 1},
+			{kind: tokPipe, text: "\\|", pos: 3},
+			{kind: tokText, text: "upper", pos: 4},
+			{kind: tokAt, text: "@", pos: 9},
+			{kind: tokText, text: " 'a", pos: 10},
+			{kind: tokPipe, text: "|", pos: 13},
+			{kind: tokText, text: "b' c\\\\\\|d", pos: 14},
+		},
+	},
+	{
+		s: "a\\\\@b",
+		e: []token{
+			{kind: tokText, text: "a\\\\@b", pos: 0},
+		},
+	},
+}
+
+func TestLex(t *testing.T) {
+	for _, x := range lexTests {
+		r := lex(x.s)
+		if len(r) != len(x.e) {
+			t.Errorf("Failed TestLex on %s - expected %v, got %v", x.s, x.e, r)
+			continue
+		}
+		for i := range r {
+			if r[i] != x.e[i] {
+				t.Errorf("Failed TestLex on %s - expected %v, got %v", x.s, x.e[i], r[i])
+			}
+		}
+	}
+}
@@ -1,6 +1,6 @@
 //go:generate go get github.com/kballard/go-shellquote
-//go:generate go build main.go expansions.go shell.go command.go strings.go
-//go:generate sh -c "GOOS=windows GOARCH=amd64 go build main.go expansions.go shell.go command.go strings.go"
+//go:generate go build main.go expansions.go shell.go command.go strings.go lexer.go parser.go dates.go ips.go data.go filters.go conditions.go runner.go output.go report.go state.go stdin.go proc_unix.go
+//go:generate sh -c "GOOS=windows GOARCH=amd64 go build main.go expansions.go shell.go command.go strings.go lexer.go parser.go dates.go ips.go data.go filters.go conditions.go runner.go output.go report.go state.go stdin.go proc_windows.go"
 //go:generate mv ./main /usr/local/bin/lup
 //go:generate mv ./main.exe lup.exe
 
@@ -9,22 +9,48 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 )
 
 var (
-	version   = "v0.4.0"
-	shell     string
-	input     string
-	dryRun    = false
-	delimiter = '@'
-	hider     = "-:"
-	testrun   = false
+	version      = "v0.4.0"
+	shell        string
+	input        []byte
+	dryRun       = false
+	delimiter    = '@'
+	hider        = "-:"
+	linker       = "=:"
+	testrun      = false
+	jobs         = 1
+	order        = "generated"
+	prefix       = false
+	prefixFormat = ""
+	maxFailures  = 0
+	retries      = 0
+	retryDelay   = time.Second
+	exponential  = false
+	jitter       = time.Duration(0)
+	timeout      = time.Duration(0)
+	killAfter    = 5 * time.Second
+	summary      = false
+	failedOnly   = false
+	jsonDest     = ""
+	jsonOutput   = false
+	stateFile    = ""
+	resume       = false
+	rerunFailed  = false
+	linkMismatch = "error"
+	hostsOnly    = false
+	wheres       []string
+	splitStdin   = ""
 )
 
 func main() {
 	shell = detectShell()
-	input = getStdin()
 	c := newCommand(os.Args[1:]...)
+	if c.sharesStdin() {
+		input = getStdin()
+	}
 	r := c.run()
 	if !testrun {
 		os.Exit(r)
@@ -36,6 +36,7 @@ func makeNodes(parent string) {
 }
 
 func TestMain(t *testing.T) {
+	defer tempState()()
 	testrun = true
 	os.Args = []string{";", "sh", "-c", "touch /tmp/luptests/main"}
 	main()
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// output holds everything a command wrote while running in parallel
+type output struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (o *output) flush(stdout io.Writer, stderr io.Writer) {
+	o.stdout.WriteTo(stdout)
+	o.stderr.WriteTo(stderr)
+}
+
+// printer writes buffered command output as contiguous blocks, holding
+// finished blocks back until their turn when generation order is wanted
+type printer struct {
+	mu      sync.Mutex
+	ordered bool
+	stdout  io.Writer
+	stderr  io.Writer
+	next    int
+	pending map[int]*output
+}
+
+func newPrinter(ordered bool, stdout io.Writer, stderr io.Writer) *printer {
+	return &printer{ordered: ordered, stdout: stdout, stderr: stderr, pending: map[int]*output{}}
+}
+
+func (p *printer) print(i int, o *output) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.ordered {
+		o.flush(p.stdout, p.stderr)
+		return
+	}
+	p.pending[i] = o
+	for {
+		o, ok := p.pending[p.next]
+		if !ok {
+			break
+		}
+		o.flush(p.stdout, p.stderr)
+		delete(p.pending, p.next)
+		p.next++
+	}
+}
+
+// prefixWriter prepends a tag to every line written through it
+type prefixWriter struct {
+	w       io.Writer
+	tag     []byte
+	midLine bool
+}
+
+func newPrefixWriter(w io.Writer, tag string) *prefixWriter {
+	return &prefixWriter{w: w, tag: []byte(tag)}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if !p.midLine {
+			if _, err := p.w.Write(p.tag); err != nil {
+				return 0, err
+			}
+		}
+		end := bytes.IndexByte(b, '\n') + 1
+		p.midLine = end == 0
+		if end == 0 {
+			end = len(b)
+		}
+		if _, err := p.w.Write(b[:end]); err != nil {
+			return 0, err
+		}
+		b = b[end:]
+	}
+	return n, nil
+}
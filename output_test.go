@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+var printerTests = []struct {
+	ordered bool
+	done    []int // order in which commands finish
+	e       string
+}{
+	{true, []int{2, 0, 1}, "0\n1\n2\n"},
+	{true, []int{0, 1, 2}, "0\n1\n2\n"},
+	{false, []int{2, 0, 1}, "2\n0\n1\n"},
+}
+
+func TestPrinter(t *testing.T) {
+	for _, x := range printerTests {
+		var stdout, stderr bytes.Buffer
+		p := newPrinter(x.ordered, &stdout, &stderr)
+		for _, i := range x.done {
+			o := &output{}
+			o.stdout.WriteString(string(rune('0'+i)) + "\n")
+			o.stderr.WriteString(string(rune('0'+i)) + "\n")
+			p.print(i, o)
+		}
+		if stdout.String() != x.e || stderr.String() != x.e {
+			t.Errorf("Failed TestPrinter - expected %q, got %q and %q", x.e, stdout.String(), stderr.String())
+		}
+	}
+}
+
+var prefixWriterTests = []struct {
+	writes []string
+	e      string
+}{
+	{[]string{"hello\nworld\n"}, "[a] hello\n[a] world\n"},
+	{[]string{"hel", "lo\nwor", "ld"}, "[a] hello\n[a] world"},
+	{[]string{"\n\n"}, "[a] \n[a] \n"},
+}
+
+func TestPrefixWriter(t *testing.T) {
+	for _, x := range prefixWriterTests {
+		var b bytes.Buffer
+		p := newPrefixWriter(&b, "[a] ")
+		for _, w := range x.writes {
+			p.Write([]byte(w))
+		}
+		if b.String() != x.e {
+			t.Errorf("Failed TestPrefixWriter - expected %q, got %q", x.e, b.String())
+		}
+	}
+}
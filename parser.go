@@ -0,0 +1,529 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// node is a piece of a parsed command line
+type node interface{}
+
+// literalNode is text outside of any group, or part of a term inside one.
+// Escapes are kept until the text is used
+type literalNode struct {
+	text string
+}
+
+// groupNode is an @ group. Each of its terms is a sequence of literals and
+// nested groups, or a single directive
+type groupNode struct {
+	pos    int
+	hidden bool
+	// linked is set for groups opened with the linker, which advance in
+	// lockstep with the group before them
+	linked bool
+	terms  [][]node
+	// filters transform each of the group's terms once expanded
+	filters []filter
+	// name is set for groups opened with name=, which backrefs can then
+	// refer to by name rather than number
+	name string
+	// path is any path immediately preceding a top level group, which
+	// files/dirs/all directives inside it are relative to
+	path      string
+	inSingles bool
+	inDoubles bool
+}
+
+// directiveNode is a term such as lines:/tmp/hosts which is expanded by
+// reading from somewhere, rather than used as it is
+type directiveNode struct {
+	pos  int
+	kind string
+	arg  string
+}
+
+// backrefNode is a group holding nothing but a reference to the term used
+// from an earlier group
+type backrefNode struct {
+	pos     int
+	ref     int
+	filters []filter
+	// field is set for backrefs such as @1.ip@, which refer to a field of
+	// the record used from a csv, tsv or json group
+	field string
+}
+
+// groupName matches the name= which can open a group, and refName a
+// backref to a named group
+var groupName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+var refName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// fieldRef matches a backref to a field of a record, e.g. 1.ip or hosts.ip
+var fieldRef = regexp.MustCompile(`^([0-9]+|[A-Za-z_][A-Za-z0-9_]*)\.(.+)$`)
+
+// conditionNode is a group opened with ?, holding conditions which
+// combinations of terms must meet rather than terms of its own
+type conditionNode struct {
+	pos  int
+	rule *rule
+}
+
+var directives = []string{"lines", "files", "dirs", "all", "dates", "cidr", "ip", "csv", "tsv", "json", "cmd"}
+
+// parseError reports a problem with the command line, pointing at the
+// column it was found at
+type parseError struct {
+	src string
+	pos int
+	msg string
+}
+
+func (e *parseError) Error() string {
+	col := utf8.RuneCountInString(e.src[:e.pos])
+	return fmt.Sprintf("%s at column %d\n  %s\n  %s^", e.msg, col+1, e.src, strings.Repeat(" ", col))
+}
+
+type parser struct {
+	src    string
+	tokens []token
+	i      int
+	// depth counts the groups the parser is inside of
+	depth int
+	// groups counts the top level groups parsed so far, for backrefs
+	groups int
+	// names maps the names given to groups so far to their numbers
+	names map[string]int
+	// unnamed holds groups which might have been meant as named backrefs,
+	// which are errors if a group of the same name comes after them
+	unnamed []*groupNode
+	// inSingles and inDoubles hold the quoting of the group being parsed,
+	// which filter arguments are unquoted according to
+	inSingles bool
+	inDoubles bool
+	// records marks the top level groups which read records from csv,
+	// tsv or json files, whose fields backrefs can refer to
+	records map[int]bool
+}
+
+// parse splits a command line into literal text, groups and backrefs
+func parse(src string) ([]node, error) {
+	p := parser{src: src, tokens: lex(src), names: map[string]int{}, records: map[int]bool{}}
+	nodes, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range p.unnamed {
+		l, ok := g.terms[0][0].(*literalNode)
+		if !ok {
+			continue
+		}
+		if n, ok := p.names[l.text]; ok {
+			return nil, p.errorf(g.pos, "Invalid backref, %s refers to group %d which comes after it", l.text, n)
+		}
+		// once groups are named, a lone word is far more likely to be a
+		// misspelt name than a group of one term
+		if len(p.names) > 0 {
+			return nil, p.errorf(g.pos, "Invalid backref, there's no group named %s", l.text)
+		}
+	}
+	return nodes, nil
+}
+
+func (p *parser) errorf(pos int, format string, a ...interface{}) error {
+	return &parseError{src: p.src, pos: pos, msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) parseCommand() (nodes []node, err error) {
+	var text strings.Builder
+	var escaping bool
+	// dropQuote is set when a condition was the only thing in a quoted
+	// word, so that its closing quote goes along with the opening one
+	var dropQuote bool
+	inSingles := state{on: false}
+	inDoubles := state{on: false}
+	pathStart := -1
+	for p.i < len(p.tokens) {
+		t := p.tokens[p.i]
+		if t.kind != tokAt {
+			for _, char := range t.text {
+				if dropQuote {
+					dropQuote = false
+					if char == '\'' {
+						inSingles.on = false
+						continue
+					}
+				}
+				if escaping {
+					escaping = char == '\\'
+					text.WriteRune(char)
+					continue
+				}
+				if pathStart == -1 && char == '/' {
+					pathStart = text.Len()
+				}
+				if pathStart > -1 && char == ' ' {
+					pathStart = -1
+				}
+				inSingles.toggle(char, '\'', false)
+				inDoubles.toggle(char, '"', false)
+				escaping = char == '\\'
+				text.WriteRune(char)
+			}
+			p.i++
+			continue
+		}
+		var path string
+		literal := text.String()
+		if pathStart > -1 {
+			literal, path = literal[:pathStart], literal[pathStart:]
+		}
+		if literal != "" {
+			nodes = append(nodes, &literalNode{text: literal})
+		}
+		text.Reset()
+		pathStart = -1
+		p.inSingles, p.inDoubles = inSingles.on, inDoubles.on
+		n, err := p.parseGroup(true)
+		if err != nil {
+			return nil, err
+		}
+		if g, ok := n.(*groupNode); ok {
+			g.path = path
+			g.inSingles, g.inDoubles = inSingles.on, inDoubles.on
+		} else if path != "" {
+			nodes = append(nodes, &literalNode{text: path})
+		}
+		nodes = append(nodes, n)
+		if _, ok := n.(*conditionNode); !ok {
+			p.groups++
+		} else if len(nodes) > 1 && inSingles.on {
+			if l, ok := nodes[len(nodes)-2].(*literalNode); ok && alone(l.text, p.tokens, p.i) {
+				l.text = l.text[:len(l.text)-1]
+				dropQuote = true
+			}
+		}
+	}
+	if text.Len() > 0 {
+		nodes = append(nodes, &literalNode{text: text.String()})
+	}
+	return
+}
+
+// parseGroup parses the group opened by the delimiter at the current
+// token, returning a backrefNode if that's all it holds
+func (p *parser) parseGroup(top bool) (node, error) {
+	open := p.tokens[p.i]
+	p.i++
+	g := &groupNode{pos: open.pos}
+	p.depth++
+	closed, err := p.parseTerms(g)
+	p.depth--
+	if err != nil {
+		return nil, err
+	}
+	if !closed {
+		return nil, p.errorf(open.pos, "Unterminated group")
+	}
+	if l, ok := first(g.terms[0]).(*literalNode); ok && strings.HasPrefix(unquote(l.text, p.inSingles, p.inDoubles), "?") {
+		if !top {
+			return nil, p.errorf(open.pos, "Conditions can't be used inside nested groups")
+		}
+		text := unquote(p.src[open.pos+1:p.tokens[p.i-1].pos], p.inSingles, p.inDoubles)
+		r, err := parseRule(text[1:])
+		if err != nil {
+			return nil, p.errorf(open.pos, "%s", err)
+		}
+		return &conditionNode{pos: open.pos, rule: r}, nil
+	}
+	if len(g.terms) == 1 && len(g.terms[0]) == 1 {
+		if l, ok := g.terms[0][0].(*literalNode); ok && regexp.MustCompile(`^[0-9]+$`).MatchString(l.text) {
+			if !top {
+				return nil, p.errorf(open.pos, "Backrefs can't be used inside nested groups")
+			}
+			n, _ := strconv.Atoi(l.text)
+			if n < 1 || n > p.groups {
+				return nil, p.errorf(open.pos, "Invalid backref, %d doesn't refer to a group before it", n)
+			}
+			return &backrefNode{pos: open.pos, ref: n, filters: g.filters}, nil
+		}
+		if l, ok := g.terms[0][0].(*literalNode); ok && top {
+			if n, field := p.field(unquote(l.text, p.inSingles, p.inDoubles)); n > 0 {
+				return &backrefNode{pos: open.pos, ref: n, filters: g.filters, field: field}, nil
+			}
+		}
+		if l, ok := g.terms[0][0].(*literalNode); ok && top && refName.MatchString(l.text) {
+			if n, ok := p.names[l.text]; ok {
+				return &backrefNode{pos: open.pos, ref: n, filters: g.filters}, nil
+			}
+			p.unnamed = append(p.unnamed, g)
+		}
+	}
+	g.finish()
+	if g.name != "" {
+		if !top {
+			return nil, p.errorf(open.pos, "Nested groups can't be named")
+		}
+		if n, ok := p.names[g.name]; ok {
+			return nil, p.errorf(open.pos, "Group name %s is already used by group %d", g.name, n)
+		}
+		p.names[g.name] = p.groups + 1
+	}
+	if top && g.hasRecords() {
+		p.records[p.groups+1] = true
+	}
+	return g, nil
+}
+
+// field reads a backref to a field of a record, returning the number of
+// the group it refers to and the field's name, or 0 if text isn't one.
+// Only groups reading records can be referred to this way, so that text
+// such as 1.5 is left as it is
+func (p *parser) field(text string) (int, string) {
+	x := fieldRef.FindStringSubmatch(text)
+	if x == nil {
+		return 0, ""
+	}
+	n, ok := p.names[x[1]]
+	if !ok {
+		n, _ = strconv.Atoi(x[1])
+	}
+	if !p.records[n] {
+		return 0, ""
+	}
+	return n, x[2]
+}
+
+// parseTerms reads the group's comma separated terms and any filters
+// following them, up to the delimiter closing the group or the end of the
+// source. It reports whether the group was closed
+func (p *parser) parseTerms(g *groupNode) (closed bool, err error) {
+	var term []node
+	defer func() {
+		g.terms = append(g.terms, term)
+	}()
+	for p.i < len(p.tokens) {
+		t := p.tokens[p.i]
+		switch {
+		case t.kind == tokComma:
+			g.terms = append(g.terms, term)
+			term = nil
+			p.i++
+		case t.kind == tokPipe && p.filterAt(p.i):
+			if g.filters, err = p.parseFilters(); err != nil {
+				return false, err
+			}
+		case t.kind == tokAt && p.canClose(g.pos, p.i, p.depth):
+			if e := p.nestedEnd(p.i, p.depth+1); e > -1 && p.leftover(e) {
+				return false, p.errorf(t.pos, "Nested groups can't follow a list, range or directive in the group they're in, put the term holding them first")
+			}
+			p.i++
+			return true, nil
+		case t.kind == tokAt && p.nestedEnd(p.i, p.depth+1) > -1:
+			n, err := p.parseGroup(false)
+			if err != nil {
+				return false, err
+			}
+			term = append(term, n)
+		case t.kind == tokAt:
+			p.i++
+			return true, nil
+		default:
+			term = append(term, &literalNode{text: t.text})
+			p.i++
+		}
+	}
+	return false, nil
+}
+
+// filterAt reports whether the pipe token at i starts a group's filters,
+// i.e. whether a filter's name follows it
+func (p *parser) filterAt(i int) bool {
+	return i+1 < len(p.tokens) && p.tokens[i+1].kind == tokText && isFilter(unquote(p.tokens[i+1].text, p.inSingles, p.inDoubles))
+}
+
+// parseFilters reads the pipe separated filters from the current token up to
+// the end of the group
+func (p *parser) parseFilters() (filters []filter, err error) {
+	for p.i < len(p.tokens) && p.tokens[p.i].kind == tokPipe {
+		pos := p.tokens[p.i].pos
+		var spec strings.Builder
+		for p.i++; p.i < len(p.tokens); p.i++ {
+			t := p.tokens[p.i]
+			if t.kind == tokAt || t.kind == tokPipe && p.filterAt(p.i) {
+				break
+			}
+			spec.WriteString(t.text)
+		}
+		f, err := newFilter(unquote(spec.String(), p.inSingles, p.inDoubles))
+		if err != nil {
+			return nil, p.errorf(pos, "%s", err)
+		}
+		filters = append(filters, f)
+	}
+	return
+}
+
+// finish picks out the hider, linker, name and any directives from the
+// group's terms. The hider and linker can be given in either order, before
+// the name. Groups where every term looks like name=, such as a list of
+// environment variables, aren't named. A group holding nothing but stdin
+// reads its terms from stdin
+func (g *groupNode) finish() {
+	if l, ok := first(g.terms[0]).(*literalNode); ok {
+		g.hidden, l.text = isHidden(l.text)
+		g.linked, l.text = isLinked(l.text)
+		if !g.hidden {
+			g.hidden, l.text = isHidden(l.text)
+		}
+		if m := groupName.FindString(l.text); m != "" && !g.assignments() {
+			g.name, l.text = m[:len(m)-1], l.text[len(m):]
+		}
+	}
+	for i, term := range g.terms {
+		text, ok := literal(term)
+		if !ok {
+			continue
+		}
+		for _, d := range directives {
+			if strings.HasPrefix(text, d+":") {
+				g.terms[i] = []node{&directiveNode{pos: g.pos, kind: d, arg: text[len(d)+1:]}}
+			}
+		}
+		if text == "stdin" && len(g.terms) == 1 {
+			g.terms[i] = []node{&directiveNode{pos: g.pos, kind: "stdin"}}
+		}
+	}
+}
+
+// literal joins the text of a term made only of literals, which is split
+// into several wherever it holds a pipe, reporting false for other terms
+func literal(term []node) (string, bool) {
+	var text string
+	for _, n := range term {
+		l, ok := n.(*literalNode)
+		if !ok {
+			return "", false
+		}
+		text += l.text
+	}
+	return text, len(term) > 0
+}
+
+// readsStdin reports whether the group is an @stdin@ group
+func (g *groupNode) readsStdin() bool {
+	d, ok := first(g.terms[0]).(*directiveNode)
+	return ok && d.kind == "stdin"
+}
+
+// hasRecords reports whether any of the group's terms are csv, tsv or json
+// directives
+func (g *groupNode) hasRecords() bool {
+	for _, term := range g.terms {
+		if d, ok := first(term).(*directiveNode); ok && isData(d.kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// assignments reports whether every term after the first starts with name=
+func (g *groupNode) assignments() bool {
+	for _, term := range g.terms[1:] {
+		if l, ok := first(term).(*literalNode); !ok || !groupName.MatchString(l.text) {
+			return false
+		}
+	}
+	return len(g.terms) > 1
+}
+
+// alone reports whether a group, following the literal text given and
+// ending before the token at i, is quoted on its own, e.g. '@?1 > 5@'
+func alone(text string, tokens []token, i int) bool {
+	if text != "'" && !strings.HasSuffix(text, " '") {
+		return false
+	}
+	if i == len(tokens) {
+		return false
+	}
+	next := tokens[i].text
+	return tokens[i].kind == tokText && (next == "'" || strings.HasPrefix(next, "' "))
+}
+
+func first(term []node) node {
+	if len(term) == 0 {
+		return nil
+	}
+	return term[0]
+}
+
+// canClose reports whether the delimiter token at i can close the group
+// opened at pos, which is depth groups deep: the group must already hold a
+// list, range or directive after any hider, linker and name, and the
+// delimiters after it must pair up into groups of their own around the closes
+// of the groups it's in. Only delimiters which can't close a group are read
+// as opening nested ones, so that neighbouring groups such as @a,b@-@c,d@
+// aren't mistaken for nesting
+func (p *parser) canClose(pos int, i int, depth int) bool {
+	text := p.src[pos+1 : p.tokens[i].pos]
+	_, text = isHidden(text)
+	_, text = isLinked(text)
+	_, text = isHidden(text)
+	if !isList(strings.TrimPrefix(text, groupName.FindString(text))) {
+		return false
+	}
+	after := 0
+	for _, t := range p.tokens[i+1:] {
+		if t.kind == tokAt {
+			after++
+		}
+	}
+	return after >= depth-1 && (after-depth+1)%2 == 0
+}
+
+// leftover reports whether closing a group rather than opening a nested
+// group whose closing delimiter is at i leaves an empty group, or one
+// starting with a comma, after it. Commands were more likely meant to nest
+// than to hold such a group, so they're errors rather than run as written
+func (p *parser) leftover(i int) bool {
+	return i+1 == len(p.tokens) || p.tokens[i+1].kind == tokAt || p.tokens[i+1].kind == tokComma
+}
+
+// nestedEnd decides whether the delimiter token at i, found inside a group,
+// opens a nested group depth groups deep rather than closing the group it's
+// in, returning the index of the nested group's closing delimiter if it does
+// and -1 if not. To be read as nested, a group must hold a list, range or
+// directive, and be followed by the rest of its term rather than by
+// whitespace
+func (p *parser) nestedEnd(i int, depth int) int {
+	if i+1 >= len(p.tokens) || p.tokens[i+1].kind != tokText || strings.ContainsAny(p.tokens[i+1].text[:1], " \t\n") {
+		return -1
+	}
+	end := -1
+	for j := i + 1; j < len(p.tokens) && end == -1; j++ {
+		if p.tokens[j].kind == tokAt {
+			if p.canClose(p.tokens[i].pos, j, depth) {
+				end = j
+			} else if e := p.nestedEnd(j, depth+1); e > -1 {
+				j = e
+			} else {
+				end = j
+			}
+		}
+	}
+	if end == -1 || !isList(p.src[p.tokens[i].pos+1:p.tokens[end].pos]) {
+		return -1
+	}
+	for j := end + 1; j < len(p.tokens); j++ {
+		if p.tokens[j].kind != tokText {
+			return end
+		}
+		if hasUnescapedSpace(p.tokens[j].text) {
+			return -1
+		}
+	}
+	return -1
+}
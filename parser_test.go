@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var parseTests = []struct {
+	s string
+	e []string
+}{
+	{
+		s: "echo @a,b@ @1@",
+		e: []string{"literal", "group", "literal", "backref"},
+	},
+	{
+		s: "ls /tmp/@files:*@",
+		e: []string{"literal", "group"},
+	},
+	{
+		s: "echo ##LUP_GROUP_0## @a@",
+		e: []string{"literal", "group"},
+	},
+	{
+		s: "echo user\\@domain",
+		e: []string{"literal"},
+	},
+}
+
+func TestParse(t *testing.T) {
+	for _, x := range parseTests {
+		nodes, err := parse(x.s)
+		if err != nil {
+			t.Errorf("Failed TestParse on %s - %s", x.s, err)
+			continue
+		}
+		var r []string
+		for _, n := range nodes {
+			switch n.(type) {
+			case *literalNode:
+				r = append(r, "literal")
+			case *groupNode:
+				r = append(r, "group")
+			case *backrefNode:
+				r = append(r, "backref")
+			}
+		}
+		if strings.Join(r, " ") != strings.Join(x.e, " ") {
+			t.Errorf("Failed TestParse on %s - expected %s, got %s", x.s, x.e, r)
+		}
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	nodes, _ := parse("ls /tmp/@-:b@a,c@,files:*@")
+	g := nodes[1].(*groupNode)
+	if g.path != "/tmp/" || !g.hidden || g.pos != 8 {
+		t.Errorf("Failed TestParseGroup - got path %s, hidden %t, pos %d", g.path, g.hidden, g.pos)
+	}
+	if d, ok := g.terms[1][0].(*directiveNode); !ok || d.kind != "files" || d.arg != "*" {
+		t.Errorf("Failed TestParseGroup - expected files directive, got %#v", g.terms[1][0])
+	}
+	if len(g.terms[0]) != 2 {
+		t.Errorf("Failed TestParseGroup - expected nested group in first term, got %#v", g.terms[0])
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	nodes, err := parse("echo @a,b|upper|replace:A:x\\,y@ @1\\|noext@ @c\\|d@")
+	if err != nil {
+		t.Fatalf("Failed TestParseFilters - %s", err)
+	}
+	g := nodes[1].(*groupNode)
+	if len(g.terms) != 2 || len(g.filters) != 2 || g.filters[1].from != "A" || g.filters[1].to != "x,y" {
+		t.Errorf("Failed TestParseFilters - got terms %d, filters %#v", len(g.terms), g.filters)
+	}
+	if b := nodes[3].(*backrefNode); len(b.filters) != 1 || b.filters[0].name != "noext" {
+		t.Errorf("Failed TestParseFilters - expected a noext filter on the backref, got %#v", b.filters)
+	}
+	if g := nodes[5].(*groupNode); len(g.filters) != 0 || len(g.terms[0]) != 3 {
+		t.Errorf("Failed TestParseFilters - expected c|d to be left as a term, got %#v", g)
+	}
+}
+
+func TestParseCommandDirective(t *testing.T) {
+	nodes, err := parse("echo '@cmd:ls | grep x@' @cmd:ls\\|wc@")
+	if err != nil {
+		t.Fatalf("Failed TestParseCommandDirective - %s", err)
+	}
+	if d, ok := nodes[1].(*groupNode).terms[0][0].(*directiveNode); !ok || d.kind != "cmd" || d.arg != "ls | grep x" {
+		t.Errorf("Failed TestParseCommandDirective - expected a cmd directive, got %#v", nodes[1].(*groupNode).terms[0][0])
+	}
+	if d, ok := nodes[3].(*groupNode).terms[0][0].(*directiveNode); !ok || d.arg != "ls\\|wc" {
+		t.Errorf("Failed TestParseCommandDirective - expected a cmd directive, got %#v", nodes[3].(*groupNode).terms[0][0])
+	}
+}
+
+func TestParseStdin(t *testing.T) {
+	nodes, err := parse("gzip @stdin@ @f=stdin|upper@ @a,stdin@")
+	if err != nil {
+		t.Fatalf("Failed TestParseStdin - %s", err)
+	}
+	for _, i := range []int{1, 3} {
+		if g := nodes[i].(*groupNode); !g.readsStdin() {
+			t.Errorf("Failed TestParseStdin - expected group %d to read from stdin, got %#v", i, g.terms[0][0])
+		}
+	}
+	if g := nodes[5].(*groupNode); g.readsStdin() {
+		t.Errorf("Failed TestParseStdin - expected stdin to be a plain term alongside others")
+	}
+}
+
+func TestParseNames(t *testing.T) {
+	nodes, err := parse("echo @-:host=web1,web2@ @env=files:*@ @A=1,B=2@ @host|upper@ @env@")
+	if err != nil {
+		t.Fatalf("Failed TestParseNames - %s", err)
+	}
+	if g := nodes[1].(*groupNode); g.name != "host" || !g.hidden || g.terms[0][0].(*literalNode).text != "web1" {
+		t.Errorf("Failed TestParseNames - expected a hidden group named host, got %#v", g)
+	}
+	if g := nodes[3].(*groupNode); g.name != "env" {
+		t.Errorf("Failed TestParseNames - expected a group named env, got %#v", g)
+	} else if _, ok := g.terms[0][0].(*directiveNode); !ok {
+		t.Errorf("Failed TestParseNames - expected a files directive in env, got %#v", g.terms[0][0])
+	}
+	if g := nodes[5].(*groupNode); g.name != "" {
+		t.Errorf("Failed TestParseNames - expected A=1,B=2 not to be named, got %s", g.name)
+	}
+	if b := nodes[7].(*backrefNode); b.ref != 1 || len(b.filters) != 1 {
+		t.Errorf("Failed TestParseNames - expected a filtered backref to group 1, got %#v", b)
+	}
+	if b := nodes[9].(*backrefNode); b.ref != 2 {
+		t.Errorf("Failed TestParseNames - expected a backref to group 2, got %#v", b)
+	}
+}
+
+var parseErrorTests = []struct {
+	s string
+	e string
+}{
+	{
+		s: "echo @a,b",
+		e: "Unterminated group at column 6\n  echo @a,b\n       ^",
+	},
+	{
+		s: "echo @2@ @a@",
+		e: "Invalid backref, 2 doesn't refer to a group before it at column 6\n  echo @2@ @a@\n       ^",
+	},
+	{
+		s: "echo @a|replace:x@",
+		e: "Filter replace:x expects two arguments, e.g. replace:from:to at column 8\n  echo @a|replace:x@\n         ^",
+	},
+	{
+		s: "echo @host@ @host=a,b@",
+		e: "Invalid backref, host refers to group 2 which comes after it at column 6\n  echo @host@ @host=a,b@\n       ^",
+	},
+	{
+		s: "echo @host=a,b@ @hots@",
+		e: "Invalid backref, there's no group named hots at column 17\n  echo @host=a,b@ @hots@\n                  ^",
+	},
+	{
+		s: "echo @h=a@ @h=b@",
+		e: "Group name h is already used by group 1 at column 12\n  echo @h=a@ @h=b@\n             ^",
+	},
+	{
+		s: "echo @x@n=a,b@,y@",
+		e: "Nested groups can't be named at column 8\n  echo @x@n=a,b@,y@\n         ^",
+	},
+	{
+		s: "echo @google.com,microsoft.@com,net@@",
+		e: "Nested groups can't follow a list, range or directive in the group they're in, put the term holding them first at column 28\n  echo @google.com,microsoft.@com,net@@\n                             ^",
+	},
+	{
+		s: "echo @a,b.@c,d@,e@",
+		e: "Nested groups can't follow a list, range or directive in the group they're in, put the term holding them first at column 11\n  echo @a,b.@c,d@,e@\n            ^",
+	},
+	{
+		s: "echo é @a",
+		e: "Unterminated group at column 8\n  echo é @a\n         ^",
+	},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, x := range parseErrorTests {
+		_, err := parse(x.s)
+		if err == nil || err.Error() != x.e {
+			t.Errorf("Failed TestParseErrors on %s - expected %q, got %v", x.s, x.e, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isolate starts cmd in a process group of its own, so that it and anything
+// it spawns can be signalled together
+func isolate(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends sig to cmd's process group if it was isolated, or to
+// cmd alone if it shares lup's
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
+
+func terminate(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGTERM)
+}
+
+func kill(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGKILL)
+}
+
+// forward passes a signal lup has received on to cmd. Commands sharing
+// lup's process group already get a SIGINT from the terminal along with lup,
+// so only SIGTERM, which is usually sent to lup alone, is passed on to them
+func forward(cmd *exec.Cmd, sig os.Signal) error {
+	if (cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setpgid) && sig != syscall.SIGTERM {
+		return nil
+	}
+	if s, ok := sig.(syscall.Signal); ok {
+		return signalGroup(cmd, s)
+	}
+	return cmd.Process.Signal(sig)
+}
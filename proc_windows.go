@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isolate starts cmd in a process group of its own
+func isolate(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// terminate kills cmd outright, windows has no equivalent of SIGTERM
+func terminate(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// forward kills cmd, as windows processes can't be sent arbitrary signals
+func forward(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errTimeout marks commands which were killed for running too long
+var errTimeout = errors.New("timed out")
+
+// result records how a generated command fared
+type result struct {
+	attempts int
+	err      error
+	start    time.Time
+	end      time.Time
+	// cancelled is set when lup stopped the command itself, e.g. on
+	// reaching --max-failures
+	cancelled bool
+	// done is set for commands which succeeded in an earlier run and so
+	// were left out by --resume or --rerun-failed
+	done bool
+	// captured holds the command's output when --json-output is set
+	captured *output
+}
+
+// record is the JSON representation of a result written by --json
+type record struct {
+	Command  string     `json:"command"`
+	Terms    []string   `json:"terms"`
+	Status   string     `json:"status"`
+	ExitCode int        `json:"exit_code"`
+	Attempts int        `json:"attempts"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Duration float64    `json:"duration_seconds"`
+	Stdout   *string    `json:"stdout,omitempty"`
+	Stderr   *string    `json:"stderr,omitempty"`
+}
+
+// status describes the result in a word, commands which were never
+// started (e.g. after --fail-fast) are skipped
+func (r result) status() string {
+	switch {
+	case r.done:
+		return "done"
+	case r.attempts == 0:
+		return "skipped"
+	case errors.Is(r.err, errTimeout):
+		return "timeout"
+	case r.cancelled:
+		return "cancelled"
+	case r.err != nil:
+		return "failed"
+	}
+	return "ok"
+}
+
+// code returns the exit code of the command's last attempt, using 124 for
+// timeouts as timeout(1) does, and 127 for commands which couldn't start
+func (r result) code() int {
+	var exitErr *exec.ExitError
+	switch {
+	case r.err == nil:
+		return 0
+	case errors.Is(r.err, errTimeout):
+		return 124
+	case errors.As(r.err, &exitErr):
+		return exitErr.ExitCode()
+	}
+	return 127
+}
+
+// report tells the user how the run went, as a full table if a summary
+// was asked for or the run was interrupted, and otherwise just noting any
+// retries and timeouts
+func (c *command) report(interrupted bool) {
+	if summary || interrupted {
+		c.printSummary(os.Stderr)
+		return
+	}
+	var retried, extra, timedOut int
+	for _, r := range c.results {
+		if r.attempts > 1 {
+			retried++
+			extra += r.attempts - 1
+		}
+		if r.status() == "timeout" {
+			timedOut++
+		}
+	}
+	if retried > 0 {
+		fmt.Fprintf(os.Stderr, "Retried %d of %d command(s), %d extra attempt(s) in total\n", retried, len(c.commands), extra)
+	}
+	if timedOut > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d command(s) timed out\n", timedOut, len(c.commands))
+	}
+}
+
+// printSummary writes a table of every command's status, exit code, wall
+// time and attempts to w, followed by the totals for the run
+func (c *command) printSummary(w io.Writer) {
+	var first, last time.Time
+	var retries int
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCODE\tTIME\tATTEMPTS\tCOMMAND")
+	for i, r := range c.results {
+		counts[r.status()]++
+		if r.attempts > 1 {
+			retries += r.attempts - 1
+		}
+		if r.attempts > 0 {
+			if first.IsZero() || r.start.Before(first) {
+				first = r.start
+			}
+			if r.end.After(last) {
+				last = r.end
+			}
+		}
+		if failedOnly && (r.status() == "ok" || r.status() == "done") {
+			continue
+		}
+		code, took := "-", "-"
+		if r.attempts > 0 {
+			code = fmt.Sprint(r.code())
+			took = r.end.Sub(r.start).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", r.status(), code, took, r.attempts, c.commands[i])
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d command(s): %d ok, %d failed, %d timed out, %d cancelled, %d skipped, ",
+		len(c.results), counts["ok"], counts["failed"], counts["timeout"], counts["cancelled"], counts["skipped"])
+	if counts["done"] > 0 {
+		fmt.Fprintf(w, "%d done previously, ", counts["done"])
+	}
+	fmt.Fprintf(w, "%d retries, %s\n", retries, last.Sub(first).Round(time.Millisecond))
+}
+
+// record describes the result of the command at position i for --json,
+// leaving the exit code, times and output out of commands which never ran
+func (c *command) record(i int) (rec record) {
+	r := c.results[i]
+	rec.Command = c.commands[i]
+	rec.Terms = c.terms[i]
+	rec.Status = r.status()
+	rec.Attempts = r.attempts
+	if r.attempts > 0 {
+		rec.ExitCode = r.code()
+		rec.Start, rec.End = &r.start, &r.end
+		rec.Duration = r.end.Sub(r.start).Seconds()
+	}
+	if r.captured != nil {
+		stdout, stderr := r.captured.stdout.String(), r.captured.stderr.String()
+		rec.Stdout, rec.Stderr = &stdout, &stderr
+	}
+	return
+}
+
+// openJSON opens the destination given to --json, which may be a file
+// path, "-" for stdout or fd:N for an already open file descriptor. The
+// function returned closes it again, leaving stdout alone
+func openJSON(dest string) (io.Writer, func() error) {
+	if dest == "-" {
+		return os.Stdout, func() error { return nil }
+	}
+	if strings.HasPrefix(dest, "fd:") {
+		fd, err := strconv.Atoi(dest[3:])
+		if err != nil || fd < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid file descriptor for --json (%s)\n", dest)
+			os.Exit(2)
+		}
+		f := os.NewFile(uintptr(fd), dest)
+		return f, f.Close
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		errOn(err, "Couldn't open JSON output file", 15)
+	}
+	return f, f.Close
+}
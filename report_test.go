@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exitError(code int) error {
+	return exec.Command("sh", "-c", "exit "+string(rune('0'+code))).Run()
+}
+
+var resultTests = []struct {
+	r      result
+	status string
+	code   int
+}{
+	{result{attempts: 1}, "ok", 0},
+	{result{attempts: 2, err: exitError(3)}, "failed", 3},
+	{result{attempts: 1, err: errTimeout}, "timeout", 124},
+	{result{attempts: 1, err: exitError(1), cancelled: true}, "cancelled", 1},
+	{result{attempts: 1, err: errors.New("exec: not found")}, "failed", 127},
+	{result{}, "skipped", 0},
+}
+
+func TestResult(t *testing.T) {
+	for _, x := range resultTests {
+		if s := x.r.status(); s != x.status {
+			t.Errorf("Failed TestResult - expected status %s, got %s", x.status, s)
+		}
+		if c := x.r.code(); c != x.code {
+			t.Errorf("Failed TestResult - expected code %d, got %d", x.code, c)
+		}
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	defer func() { failedOnly = false }()
+	start := time.Now()
+	c := command{
+		commands: []string{"echo one", "false", "echo three"},
+		results: []result{
+			{attempts: 1, start: start, end: start.Add(time.Second)},
+			{attempts: 3, err: exitError(1), start: start, end: start.Add(2 * time.Second)},
+			{},
+		},
+	}
+	for _, f := range []bool{false, true} {
+		var b bytes.Buffer
+		failedOnly = f
+		c.printSummary(&b)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if len(lines) != 5 && !f || len(lines) != 4 && f {
+			t.Errorf("Failed TestPrintSummary (failed only: %t) - got %d lines:\n%s", f, len(lines), b.String())
+			continue
+		}
+		e := "ok 0 1s 1 echo one"
+		if f {
+			e = "failed 1 2s 3 false"
+		}
+		if row := strings.Join(strings.Fields(lines[1]), " "); row != e {
+			t.Errorf("Failed TestPrintSummary (failed only: %t) - expected row %q, got %q", f, e, row)
+		}
+		if e := "3 command(s): 1 ok, 1 failed, 0 timed out, 0 cancelled, 1 skipped, 2 retries, 2s"; lines[len(lines)-1] != e {
+			t.Errorf("Failed TestPrintSummary - expected totals %q, got %q", e, lines[len(lines)-1])
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { jsonDest, jsonOutput = "", false }()
+	c := newCommand("--json", "/tmp/luptests/results.json", "--json-output", "sh", "-c", "echo @a,b@; exit @0,2@")
+	c.run()
+	f, err := os.Open("/tmp/luptests/results.json")
+	if err != nil {
+		t.Fatalf("Failed TestJSON - couldn't open results: %s", err)
+	}
+	defer os.Remove("/tmp/luptests/results.json")
+	defer f.Close()
+	var records []record
+	d := json.NewDecoder(f)
+	for d.More() {
+		var rec record
+		if err := d.Decode(&rec); err != nil {
+			t.Fatalf("Failed TestJSON - couldn't decode record: %s", err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Failed TestJSON - expected 4 records, got %d", len(records))
+	}
+	last := records[3]
+	if last.Command != "sh -c 'echo b; exit 2'" || strings.Join(last.Terms, ",") != "b,2" || last.ExitCode != 2 || last.Status != "failed" || *last.Stdout != "b\n" {
+		t.Errorf("Failed TestJSON - unexpected record %+v", last)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+func (c *command) run() int {
+	var retcode int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	state := c.loadState()
+	if rerunFailed && !state.found() {
+		fmt.Fprintln(os.Stderr, "No previous run of this command was found to rerun failures from")
+		return 1
+	}
+	if dryRun {
+		show := func(i int) bool {
+			if state.wanted(i) {
+				line, _ := prepare(c.commands[i])
+				fmt.Println(line)
+			}
+			return true
+		}
+		for i := range c.commands {
+			show(i)
+		}
+		if c.stdin > 0 {
+			c.stream(context.Background(), &mu, state, show)
+		}
+		return retcode
+	}
+	if splitStdin != "" {
+		c.split()
+	}
+
+	// cancelling ctx kills running commands, whereas cancelling stop only
+	// prevents new ones from starting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop, stopScheduling := context.WithCancel(ctx)
+	defer stopScheduling()
+	var failures int
+	var caught os.Signal
+	var records *json.Encoder
+	c.results = make([]result, len(c.commands))
+	for i := range c.results {
+		c.results[i].done = !state.wanted(i) && state.Statuses[i] == "ok"
+	}
+	if jsonDest != "" {
+		f, closeJSON := openJSON(jsonDest)
+		defer closeJSON()
+		records = json.NewEncoder(f)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				mu.Lock()
+				if caught == nil {
+					caught = sig
+					fmt.Fprintf(os.Stderr, "Caught %s, waiting for running commands to exit (repeat to kill them)\n", sig)
+					stopScheduling()
+					signalChildren(sig)
+				} else {
+					cancel()
+				}
+				mu.Unlock()
+			case <-finished:
+				return
+			}
+		}
+	}()
+	out := newPrinter(order == "generated", os.Stdout, os.Stderr)
+	queue := make(chan int)
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if stop.Err() != nil {
+					out.print(i, &output{})
+					continue
+				}
+				mu.Lock()
+				command, tag := c.commands[i], ""
+				if prefix {
+					tag = c.tag(i)
+				}
+				mu.Unlock()
+				r := c.runOne(ctx, stop, i, command, tag, out)
+				mu.Lock()
+				c.results[i] = r
+				if records != nil {
+					records.Encode(c.record(i))
+				}
+				state.Statuses[i] = c.results[i].status()
+				state.checkpoint()
+				if c.results[i].err != nil {
+					retcode = 1
+					failures++
+					if maxFailures > 0 && failures == maxFailures {
+						fmt.Fprintf(os.Stderr, "Stopping after %d failed command(s)\n", failures)
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	// commands which aren't run are still handed to the printer, so that
+	// the output of those after them isn't held back waiting for theirs
+	send := func(i int) bool {
+		if !state.wanted(i) {
+			out.print(i, &output{})
+			return true
+		}
+		select {
+		case queue <- i:
+			return true
+		case <-stop.Done():
+			return false
+		}
+	}
+	for i := range c.commands {
+		if !send(i) {
+			break
+		}
+	}
+	if c.stdin > 0 && stop.Err() == nil {
+		c.stream(stop, &mu, state, send)
+	}
+	close(queue)
+	wg.Wait()
+	for i, r := range c.results {
+		if records != nil && r.attempts == 0 {
+			records.Encode(c.record(i))
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.report(caught != nil)
+	succeeded := true
+	for i, r := range c.results {
+		if errors.Is(r.err, errTimeout) {
+			retcode = 124
+		}
+		succeeded = succeeded && state.Statuses[i] == "ok"
+	}
+	if succeeded {
+		state.clear()
+	} else {
+		state.save()
+	}
+	if sig, ok := caught.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return retcode
+}
+
+// runOne runs the command at position i, buffering and prefixing its
+// output with tag as the current options require and retrying it on failure
+// unless stop is cancelled. Cancelling ctx kills the command
+func (c *command) runOne(ctx context.Context, stop context.Context, i int, command string, tag string, out *printer) (r result) {
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	o := &output{}
+	if jobs > 1 {
+		stdout, stderr = &o.stdout, &o.stderr
+	}
+	if prefix {
+		stdout, stderr = newPrefixWriter(stdout, tag), newPrefixWriter(stderr, tag)
+	}
+	if jsonOutput {
+		r.captured = &output{}
+		stdout, stderr = io.MultiWriter(stdout, &r.captured.stdout), io.MultiWriter(stderr, &r.captured.stderr)
+	}
+	r.start = time.Now()
+	for {
+		r.attempts++
+		r.err = execute(ctx, command, c.stdinFor(i), stdout, stderr)
+		if r.err == nil || r.attempts > retries || stop.Err() != nil {
+			break
+		}
+		fmt.Fprintf(stderr, "Retrying %s (attempt %d of %d)\n", command, r.attempts+1, retries+1)
+		if !sleep(stop, backoff(r.attempts)) {
+			break
+		}
+	}
+	r.end = time.Now()
+	r.cancelled = r.err != nil && stop.Err() != nil
+	if jobs > 1 {
+		out.print(i, o)
+	}
+	return r
+}
+
+// maxBackoff caps how long exponential backoff waits between attempts,
+// unless --retry-delay is longer to begin with
+const maxBackoff = 5 * time.Minute
+
+// backoff returns how long to wait before retrying a command which has
+// failed the given number of times
+func backoff(failures int) time.Duration {
+	d := retryDelay
+	if exponential {
+		for n := 1; n < failures && d < maxBackoff; n++ {
+			d *= 2
+		}
+		if d > maxBackoff && retryDelay <= maxBackoff {
+			d = maxBackoff
+		}
+	}
+	if jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return d
+}
+
+// sleep waits for d, returning false early if ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// children tracks the commands which are currently running so that signals
+// lup receives can be passed on to them
+var children = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]bool
+}{cmds: map[*exec.Cmd]bool{}}
+
+// signalChildren forwards sig to every running command which wouldn't
+// otherwise get it
+func signalChildren(sig os.Signal) {
+	children.Lock()
+	defer children.Unlock()
+	for cmd := range children.cmds {
+		forward(cmd, sig)
+	}
+}
+
+// execute runs a single generated command, reading from stdin and sending
+// its output to the writers given. If ctx is cancelled or the command outlives the timeout
+// it is sent SIGTERM, followed by SIGKILL if still running after killAfter
+func execute(ctx context.Context, command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	var expired <-chan time.Time
+	_, cmd := prepare(command)
+	if cmd == nil {
+		return nil
+	}
+	cmd.Stdout, cmd.Stdin, cmd.Stderr = stdout, stdin, stderr
+	if timeout > 0 || jobs > 1 {
+		isolate(cmd)
+		cmd.Stdin = isolatedStdin(stdin)
+	}
+	children.Lock()
+	err := cmd.Start()
+	if err == nil {
+		children.cmds[cmd] = true
+	}
+	children.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		children.Lock()
+		delete(children.cmds, cmd)
+		children.Unlock()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	var expiredFirst bool
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	case <-expired:
+		expiredFirst = true
+	}
+	terminate(cmd)
+	grace := time.NewTimer(killAfter)
+	defer grace.Stop()
+	select {
+	case err = <-done:
+	case <-grace.C:
+		kill(cmd)
+		err = <-done
+	}
+	if expiredFirst {
+		fmt.Fprintf(stderr, "Timed out after %s: %s\n", timeout, command)
+		return errTimeout
+	}
+	return err
+}
+
+// isolatedStdin returns what a command in a process group of its own reads
+// as its stdin. Such a command is in the background as far as the terminal
+// is concerned, so it gets nothing rather than being stopped by SIGTTIN as
+// soon as it tries to read from the terminal
+func isolatedStdin(stdin io.Reader) io.Reader {
+	if f, ok := stdin.(*os.File); ok && isTerminal(f) {
+		return nil
+	}
+	return stdin
+}
+
+// prepare wraps a generated command for the detected shell, returning the
+// line shown on dry runs and the exec.Cmd which runs it. Commands which
+// split to nothing return a nil exec.Cmd
+func prepare(command string) (string, *exec.Cmd) {
+	switch shell {
+	case "powershell.exe":
+		command = "powershell -C " + strings.Replace(command, "\\!", "!", -1)
+	case "cmd.exe":
+		//todo
+	}
+	if shell == "powershell" {
+		return "powershell -Command " + command, exec.Command("powershell", "-Command", command)
+	}
+	t, err := shellquote.Split(command)
+	if err != nil {
+		errOn(err, "Couldn't split command", 5)
+	}
+	if len(t) == 0 {
+		return command, nil
+	}
+	return command, exec.Command(t[0], t[1:]...)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var runJobsTests = []struct {
+	s     []string
+	files []string
+	e     int
+}{
+	{
+		s:     []string{"-j", "3", "sh", "-c", "cd /tmp/luptests && touch jobs@1..5@"},
+		files: []string{"jobs1", "jobs2", "jobs3", "jobs4", "jobs5"},
+		e:     0,
+	},
+	{
+		s: []string{"--jobs", "2", "@true,false,true@"},
+		e: 1,
+	},
+}
+
+func TestRunJobs(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { jobs = 1 }()
+	os.MkdirAll("/tmp/luptests", 0700)
+	for _, x := range runJobsTests {
+		c := newCommand(x.s...)
+		if r := c.run(); r != x.e {
+			t.Errorf("Failed TestRunJobs on %s - expected return code %d, got %d", x.s, x.e, r)
+		}
+		for _, f := range x.files {
+			if _, err := os.Stat("/tmp/luptests/" + f); err != nil {
+				t.Errorf("Failed TestRunJobs on %s - %s wasn't created", x.s, f)
+			} else {
+				os.Remove("/tmp/luptests/" + f)
+			}
+		}
+	}
+}
+
+var maxFailuresTests = []struct {
+	s       []string
+	created []string
+	skipped []string
+}{
+	{
+		s:       []string{"--fail-fast", "sh", "-c", "cd /tmp/luptests && touch ff@1..4@ && test @1@ -lt 2"},
+		created: []string{"ff1", "ff2"},
+		skipped: []string{"ff3", "ff4"},
+	},
+	{
+		s:       []string{"--max-failures", "2", "sh", "-c", "cd /tmp/luptests && touch mf@1..4@ && test @1@ -lt 2"},
+		created: []string{"mf1", "mf2", "mf3"},
+		skipped: []string{"mf4"},
+	},
+}
+
+func TestMaxFailures(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { maxFailures = 0 }()
+	os.MkdirAll("/tmp/luptests", 0700)
+	for _, x := range maxFailuresTests {
+		c := newCommand(x.s...)
+		if r := c.run(); r != 1 {
+			t.Errorf("Failed TestMaxFailures on %s - expected return code 1, got %d", x.s, r)
+		}
+		for _, f := range x.created {
+			if _, err := os.Stat("/tmp/luptests/" + f); err != nil {
+				t.Errorf("Failed TestMaxFailures on %s - %s wasn't created", x.s, f)
+			}
+			os.Remove("/tmp/luptests/" + f)
+		}
+		for _, f := range x.skipped {
+			if _, err := os.Stat("/tmp/luptests/" + f); err == nil {
+				t.Errorf("Failed TestMaxFailures on %s - %s was created", x.s, f)
+				os.Remove("/tmp/luptests/" + f)
+			}
+		}
+	}
+}
+
+func TestFailFastCancels(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { jobs, maxFailures = 1, 0 }()
+	c := newCommand("-j", "2", "--fail-fast", "@false,sleep@", "5")
+	start := time.Now()
+	c.run()
+	if d := time.Since(start); d > 4*time.Second {
+		t.Errorf("Failed TestFailFastCancels - running command wasn't cancelled (took %s)", d)
+	}
+}
+
+var retriesTests = []struct {
+	retries  string
+	e        int
+	attempts int
+}{
+	{"2", 0, 3},
+	{"1", 1, 2},
+}
+
+func TestRetries(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { retries, retryDelay = 0, time.Second }()
+	os.MkdirAll("/tmp/luptests", 0700)
+	for _, x := range retriesTests {
+		os.Remove("/tmp/luptests/retries")
+		c := newCommand("--retries", x.retries, "--retry-delay", "1ms", "sh", "-c", "cd /tmp/luptests && echo >> retries && test $(wc -l < retries) -ge 3")
+		if r := c.run(); r != x.e {
+			t.Errorf("Failed TestRetries with %s retries - expected return code %d, got %d", x.retries, x.e, r)
+		}
+		if c.results[0].attempts != x.attempts {
+			t.Errorf("Failed TestRetries with %s retries - expected %d attempts, got %d", x.retries, x.attempts, c.results[0].attempts)
+		}
+	}
+	os.Remove("/tmp/luptests/retries")
+}
+
+var backoffTests = []struct {
+	exponential bool
+	failures    int
+	e           time.Duration
+}{
+	{false, 1, time.Second},
+	{false, 3, time.Second},
+	{true, 1, time.Second},
+	{true, 3, 4 * time.Second},
+	{true, 9, 256 * time.Second},
+	{true, 10, maxBackoff},
+	{true, 100, maxBackoff},
+}
+
+func TestBackoff(t *testing.T) {
+	defer func() { exponential = false }()
+	for _, x := range backoffTests {
+		exponential = x.exponential
+		if d := backoff(x.failures); d != x.e {
+			t.Errorf("Failed TestBackoff - expected %s after %d failures, got %s", x.e, x.failures, d)
+		}
+	}
+	exponential, retryDelay = true, 10*time.Minute
+	if d := backoff(70); d != 10*time.Minute {
+		t.Errorf("Failed TestBackoff - expected a retry delay over the cap to be kept, got %s", d)
+	}
+	exponential, retryDelay = false, time.Second
+	jitter = time.Second
+	defer func() { jitter = 0 }()
+	if d := backoff(1); d < time.Second || d >= 2*time.Second {
+		t.Errorf("Failed TestBackoff - jittered delay %s out of range", d)
+	}
+}
+
+var timeoutTests = []struct {
+	s []string
+	e int
+}{
+	{[]string{"--timeout", "100ms", "sleep", "@5,0@"}, 124},
+	{[]string{"--timeout", "100ms", "--kill-after", "100ms", "sh", "-c", "trap '' TERM; sleep 5"}, 124},
+	{[]string{"-j", "2", "--timeout", "100ms", "--kill-after", "100ms", "sh", "-c", "trap '' TERM; sleep 5 & wait"}, 124},
+	{[]string{"--timeout", "5s", "true"}, 0},
+}
+
+func TestTimeout(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { jobs, timeout, killAfter = 1, 0, 5*time.Second }()
+	for _, x := range timeoutTests {
+		c := newCommand(x.s...)
+		start := time.Now()
+		if r := c.run(); r != x.e {
+			t.Errorf("Failed TestTimeout on %s - expected return code %d, got %d", x.s, x.e, r)
+		}
+		if d := time.Since(start); d > 4*time.Second {
+			t.Errorf("Failed TestTimeout on %s - command wasn't killed (took %s)", x.s, d)
+		}
+	}
+}
+
+var runInputTests = []struct {
+	split string
+	s     []string
+	e     map[string]string
+}{
+	{
+		s: []string{"-j", "2", "sh", "-c", "cat > /tmp/luptests/input@1,2@"},
+		e: map[string]string{"input1": "-n \x00\xff\r\nno newline", "input2": "-n \x00\xff\r\nno newline"},
+	},
+	{
+		split: "round-robin",
+		s:     []string{"sh", "-c", "cat > /tmp/luptests/input@1,2@"},
+		e:     map[string]string{"input1": "-n \x00\xff\r\n", "input2": "no newline"},
+	},
+	{
+		s: []string{"--retries", "1", "--retry-delay", "1ms", "sh", "-c", "cat >> /tmp/luptests/input1; test -e /tmp/luptests/retried || { touch /tmp/luptests/retried; exit 1; }"},
+		e: map[string]string{"input1": "-n \x00\xff\r\nno newline-n \x00\xff\r\nno newline"},
+	},
+}
+
+func TestRunInput(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() {
+		input, splitStdin, jobs, retries, retryDelay = nil, "", 1, 0, time.Second
+		os.Remove("/tmp/luptests/retried")
+	}()
+	os.MkdirAll("/tmp/luptests", 0700)
+	for _, x := range runInputTests {
+		input, splitStdin = []byte("-n \x00\xff\r\nno newline"), x.split
+		c := newCommand(x.s...)
+		if r := c.run(); r != 0 {
+			t.Errorf("Failed TestRunInput on %s - expected return code 0, got %d", x.s, r)
+		}
+		for f, e := range x.e {
+			data, err := ioutil.ReadFile("/tmp/luptests/" + f)
+			if err != nil || string(data) != e {
+				t.Errorf("Failed TestRunInput on %s - expected %s to hold %q, got %q", x.s, f, e, data)
+			}
+			os.Remove("/tmp/luptests/" + f)
+		}
+	}
+}
+
+func TestIsolatedStdin(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Failed TestIsolatedStdin - %s", err)
+	}
+	defer null.Close()
+	if r := isolatedStdin(null); r != nil {
+		t.Errorf("Failed TestIsolatedStdin - expected a terminal not to be passed on, got %v", r)
+	}
+	ioutil.WriteFile("/tmp/luptests/isolated", []byte("x\n"), 0600)
+	defer os.Remove("/tmp/luptests/isolated")
+	f, _ := os.Open("/tmp/luptests/isolated")
+	defer f.Close()
+	if r := isolatedStdin(f); r != f {
+		t.Errorf("Failed TestIsolatedStdin - expected a file to be passed on, got %v", r)
+	}
+	if r := isolatedStdin(strings.NewReader("x")); r == nil {
+		t.Errorf("Failed TestIsolatedStdin - expected buffered input to be passed on")
+	}
+}
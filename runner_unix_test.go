@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignals(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func() { jobs = 1 }()
+	c := newCommand("-j", "2", "sleep", "@5,5,5,5@")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	start := time.Now()
+	if r := c.run(); r != 143 {
+		t.Errorf("Failed TestSignals - expected return code 143, got %d", r)
+	}
+	if d := time.Since(start); d > 4*time.Second {
+		t.Errorf("Failed TestSignals - SIGTERM wasn't forwarded (took %s)", d)
+	}
+	var statuses []string
+	for _, r := range c.results {
+		statuses = append(statuses, r.status())
+	}
+	if s := strings.Join(statuses, ","); s != "cancelled,cancelled,skipped,skipped" {
+		t.Errorf("Failed TestSignals - unexpected statuses %s", s)
+	}
+}
+
+func TestInterruptSharedGroup(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	os.MkdirAll("/tmp/luptests", 0700)
+	defer os.Remove("/tmp/luptests/interrupted")
+	c := newCommand("sh", "-c", "trap 'echo INT >> /tmp/luptests/interrupted' INT; sleep 1 & wait; sleep 1 & wait; echo @done@ > /dev/null")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	if r := c.run(); r != 130 {
+		t.Errorf("Failed TestInterruptSharedGroup - expected return code 130, got %d", r)
+	}
+	if _, err := os.Stat("/tmp/luptests/interrupted"); err == nil {
+		t.Errorf("Failed TestInterruptSharedGroup - SIGINT was passed on to a command sharing lup's process group")
+	}
+}
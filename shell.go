@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 
@@ -9,7 +10,7 @@ import (
 )
 
 func showHelp() {
-	fmt.Println(`Usage: lup [OPTION] COMMANDLINE
+	io.WriteString(os.Stdout, `Usage: lup [OPTION] COMMANDLINE
 
 Run multiple similar commands expanding at-symbol encapsulated, comma-separated lists similarly to nested for loops.
 
@@ -32,6 +33,30 @@ To iterate through a range of numbers, use @i..j@ where i and j are integer valu
 
   lup echo "@9..0@@0..9@"
 
+A step can follow the range, and leading zeros on either end pad every number to the same width. A printf verb after the range formats each number, e.g. as hex.
+
+  lup echo "@00..100..10@" "@0..255..16%02x@"
+
+Letters count in the same way, as do ranges whose ends only differ in the letter or number they end with.
+
+  lup echo "@a..f@" "@sda..sdf@" "@node-a1..node-a9@"
+
+Dates can be iterated through with the dates directive, a day at a time unless a step (e.g. 6h, 1w or 1mo) is given, and written in a strftime style layout or a Go layout in braces.
+
+  lup backfill --day "@dates:2026-01-01..2026-01-31@"
+  lup backfill --hour "@dates:2026-01-01..2026-01-02..6h%Y%m%d%H@"
+
+IPv4 and IPv6 addresses can be iterated through with the cidr and ip directives, which take a CIDR block or a range of addresses.
+
+  lup --hosts-only ping -c1 "@cidr:10.0.0.0/28@"
+  lup ssh "@ip:10.0.0.5..10.0.0.20@" uptime
+
+Filters
+-------
+Terms in a group or backref can be transformed by adding filters after a |, such as upper, lower, trim, basename, dirname, ext, noext, replace:FROM:TO and sub:REGEX:REPL.
+
+  lup convert "@files:*.jpg@" "@1|noext@.png"
+
 Hiding
 ------
 To "hide" a group, you can prefix its contents with -: the following will echo iterate through the hidden block echoing "Hello" 5 times, but otherwise do nothing with its values
@@ -44,6 +69,18 @@ You can reference previous blocks in a command by including a standalone integer
 
   lup @-:1..5@ echo "Hello @1@"
 
+Groups can also be named by opening them with name=, and referred to by name rather than number.
+
+  lup @-:n=1..5@ echo "Hello @n@"
+
+Nesting
+-------
+Terms in a group can contain groups of their own, which are expanded into the enclosing group's terms. A nested group must hold a list, range or directive, and be followed by a comma or the enclosing group's closing @. An @ can only open a nested group where it couldn't close the enclosing one, so terms holding nested groups should come first.
+
+  lup nslookup @microsoft.@com,net,org@,google.com@
+
+Backrefs only count the outermost groups, and can't be used inside nested groups.
+
 Reading Files
 -------------
 
@@ -60,6 +97,19 @@ Text files can be used in @ blocks and injected line by line. For example, given
   echo Leela
   echo Bender
 
+Records can be read from CSV and TSV files with a header row, and from JSON files given a path to the values, with @csv:...@, @tsv:...@ and @json:FILE#PATH@. Backrefs can pick out each record's fields by name, or for CSV and TSV by column number.
+
+  lup ssh @csv:hosts.csv@ --ip @1.ip@ --role @1.role@
+  lup deploy "@-:h=json:inventory.json#.hosts[*]@" "@h.name@" "@h.loc.dc@"
+
+A command's output can be used in the same way as a file with @cmd:...@, which runs the command through sh -c when the group is expanded, even on dry runs.
+
+  lup kubectl delete --all pods -n "@cmd:kubectl get ns -o name | cut -d/ -f2@"
+
+Lines piped into lup can be used as terms with @stdin@, starting the commands for each line as it arrives, like xargs.
+
+  find . -name '*.log' | lup -j 4 gzip @stdin@
+
 Filesystem
 ----------
 Directives are available for iterating through files/directories/everything in a specific path. These are 'files,' 'dirs,' and 'all' respectively.
@@ -98,9 +148,72 @@ More detail on usage is available at https://github.com/udkyo/lup
 
 Options:
 
-  -h, --help     Show this help message and exit
-  -V, --version  Show version information and exit
-  -t, --test     Show commands, but do not execute them`)
+  -h, --help        Show this help message and exit
+  -V, --version     Show version information and exit
+  -t, --test        Show commands, but do not execute them
+  -j, --jobs N      Run up to N commands at the same time (default 1)
+      --order MODE  When running in parallel, print each command's output
+                    in the order commands were "generated" (default) or
+                    the order they "completed"
+  -p, --prefix      Prefix each line of output with the terms used to
+                    generate the command which wrote it, e.g. "[web01 prod] "
+      --prefix-format FORMAT
+                    Prefix each line of output with FORMAT, expanding
+                    backrefs in it, e.g. "@2@: "
+      --link-mismatch MODE
+                    What to do when groups linked with =: have different
+                    lengths, either "error" (the default), "pad" the
+                    shorter ones with empty terms or "truncate" the
+                    longer ones
+      --where COND  Only run commands whose terms meet COND, e.g.
+                    'env != prod', 'host =~ ^web' or '1 >= 10'. Can be
+                    given more than once
+      --hosts-only  Leave the network and broadcast addresses out of cidr
+                    directives
+      --split-stdin MODE
+                    Share the lines of stdin out between the commands
+                    rather than giving each all of it, either a line at a
+                    time ("round-robin"), N lines at a time ("chunks:N")
+                    or a line to each command ("records")
+      --fail-fast   Stop starting new commands after the first failure,
+                    cancelling any which are still running
+      --max-failures N
+                    As --fail-fast, but only once N commands have failed
+      --retries N   Retry each failing command up to N more times
+      --retry-delay DURATION
+                    How long to wait before retrying (default 1s)
+      --backoff MODE
+                    Wait the same time between every attempt ("fixed",
+                    the default) or double it each time ("exponential"),
+                    up to 5m
+      --jitter DURATION
+                    Add a random wait of up to DURATION before each retry
+      --timeout DURATION
+                    Stop any command still running after DURATION, which
+                    is then treated as failed. lup returns 124 if any
+                    command timed out
+      --kill-after DURATION
+                    How long a stopped command has to exit after SIGTERM
+                    before it is sent SIGKILL (default 5s)
+  -s, --summary     Once every command has finished, print a table of
+                    their statuses, exit codes, times and attempts to stderr
+      --failed-only As --summary, but only list commands which didn't
+                    succeed
+      --json DEST   Write a JSON record for each command to DEST as it
+                    finishes, one per line. DEST may be a file, - for
+                    stdout, or fd:N to use an open file descriptor
+      --json-output Include each command's stdout and stderr in its
+                    JSON record
+      --resume      Skip any commands which succeeded the last time this
+                    command line was run
+      --rerun-failed
+                    Only run the commands which failed the last time this
+                    command line was run
+      --state-file PATH
+                    Where to keep track of each command's status for
+                    --resume and --rerun-failed (default: a file named
+                    after the command line in lup's cache directory)
+`)
 	if !testrun {
 		os.Exit(0)
 	}
@@ -114,21 +227,29 @@ func detectShell() string {
 	return (p.Executable())
 }
 
-func getStdin() string {
-	inp := ""
+// isTerminal reports whether f is a terminal, or another character device
+// such as /dev/null which there's no sense in reading from up front
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// getStdin reads the whole of stdin, exactly as it was given, so that it
+// can be passed on to every command. Nothing is read from a terminal, which
+// commands are left to read from themselves
+func getStdin() []byte {
 	file := os.Stdin
-	fi, err := file.Stat()
-	if err != nil {
+	if _, err := file.Stat(); err != nil {
 		fmt.Fprintln(os.Stderr, "file.Stat()", err)
 		os.Exit(3)
 	}
-	size := fi.Size()
-	if size > 0 {
-		data, _ := ioutil.ReadAll(os.Stdin)
-		inp = string(data)
-		if len(inp) > 0 {
-			inp = inp[:len(string(data))-1]
-		}
+	if isTerminal(file) && splitStdin == "" {
+		return nil
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read stdin", err)
+		os.Exit(3)
 	}
-	return inp
+	return data
 }
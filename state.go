@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// saveInterval is the least time left between saves of the state while
+// commands are running, so that long runs don't spend their time rewriting it
+const saveInterval = time.Second
+
+// runState is persisted while commands run so that an interrupted or
+// partly failed run can be picked up again with --resume or --rerun-failed
+type runState struct {
+	Command string `json:"command"`
+	// Key is the stateKey of the run, which changes along with the
+	// commands it expanded to
+	Key string `json:"key"`
+	// Statuses holds the latest status of each generated command
+	Statuses []string `json:"statuses"`
+	path     string
+	warned   bool
+	saved    time.Time
+}
+
+// stateKey identifies a run by its command line and the commands it
+// expanded to, so that a change to either starts afresh
+func (c *command) stateKey() string {
+	h := sha256.New()
+	fmt.Fprintln(h, c.original)
+	fmt.Fprint(h, strings.Join(c.commands, "\n"))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// loadState reads the state of the last matching run from --state-file or
+// lup's cache directory, returning a blank state if there isn't one. Runs
+// reading @stdin@ can't be resumed, so their state is never saved
+func (c *command) loadState() *runState {
+	s := &runState{Command: c.original, Key: c.stateKey(), Statuses: make([]string, len(c.commands)), path: stateFile}
+	for i := range s.Statuses {
+		s.Statuses[i] = "skipped"
+	}
+	if c.stdin > 0 {
+		s.path = ""
+		return s
+	}
+	if s.path == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return s
+		}
+		s.path = filepath.Join(dir, "lup", s.Key+".json")
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return s
+	}
+	var prev runState
+	if json.Unmarshal(data, &prev) == nil && prev.Key == s.Key && len(prev.Statuses) == len(c.commands) {
+		s.Statuses = prev.Statuses
+	}
+	return s
+}
+
+// found reports whether any commands from a previous run were recorded
+func (s *runState) found() bool {
+	for _, st := range s.Statuses {
+		if st != "skipped" {
+			return true
+		}
+	}
+	return false
+}
+
+// wanted reports whether the command at position i should be run, given
+// --resume and --rerun-failed
+func (s *runState) wanted(i int) bool {
+	switch {
+	case resume:
+		return s.Statuses[i] != "ok"
+	case rerunFailed:
+		return s.Statuses[i] == "failed" || s.Statuses[i] == "timeout" || s.Statuses[i] == "cancelled"
+	}
+	return true
+}
+
+// save writes the state out, replacing the previous file in one go so an
+// interrupted save can't leave it half written
+func (s *runState) save() {
+	if s.path == "" {
+		return
+	}
+	s.saved = time.Now()
+	data, _ := json.Marshal(s)
+	err := os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(s.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil && !s.warned {
+		fmt.Fprintf(os.Stderr, "Couldn't save state to %s, --resume won't be able to pick this run up\n  - %s\n", s.path, err)
+		s.warned = true
+	}
+}
+
+// checkpoint saves the state unless it was saved within the last
+// saveInterval, the rest being left for the save once the run ends
+func (s *runState) checkpoint() {
+	if time.Since(s.saved) >= saveInterval {
+		s.save()
+	}
+}
+
+// clear removes the state file once there's nothing left to resume
+func (s *runState) clear() {
+	if s.path != "" {
+		os.Remove(s.path)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempState points stateFile at a temporary directory for a test, so that
+// its runs don't leave state files in lup's cache directory, returning a
+// function which clears it up again
+func tempState() func() {
+	dir, _ := ioutil.TempDir("", "luptests")
+	stateFile = filepath.Join(dir, "state")
+	return func() {
+		stateFile = ""
+		os.RemoveAll(dir)
+	}
+}
+
+var stateTests = []struct {
+	flags []string
+	e     int
+	lines []int // lines in each file once run
+}{
+	{[]string{}, 1, []int{1, 1, 1}},
+	{[]string{"--resume"}, 1, []int{1, 2, 1}},
+	{[]string{"--rerun-failed"}, 1, []int{1, 3, 1}},
+}
+
+func TestState(t *testing.T) {
+	dryRun = false
+	defer func() { stateFile, resume, rerunFailed = "", false, false }()
+	os.MkdirAll("/tmp/luptests", 0700)
+	for _, f := range []string{"state", "st1", "st2", "st3"} {
+		os.Remove("/tmp/luptests/" + f)
+	}
+	for _, x := range stateTests {
+		resume, rerunFailed = false, false
+		args := append(x.flags, "--state-file", "/tmp/luptests/state", "sh", "-c", "cd /tmp/luptests && echo >> st@1..3@ && test @1@ -ne 2")
+		c := newCommand(args...)
+		if r := c.run(); r != x.e {
+			t.Errorf("Failed TestState with %s - expected return code %d, got %d", x.flags, x.e, r)
+		}
+		for i, n := range x.lines {
+			data, _ := ioutil.ReadFile("/tmp/luptests/st" + string(rune('1'+i)))
+			if l := strings.Count(string(data), "\n"); l != n {
+				t.Errorf("Failed TestState with %s - expected command %d to have run %d time(s), got %d", x.flags, i+1, n, l)
+			}
+		}
+	}
+	resume, rerunFailed = false, false
+	c := newCommand("--state-file", "/tmp/luptests/state", "true")
+	c.run()
+	if _, err := os.Stat("/tmp/luptests/state"); err == nil {
+		t.Errorf("Failed TestState - state file wasn't removed after a successful run")
+	}
+	rerunFailed = true
+	if r := c.run(); r != 1 {
+		t.Errorf("Failed TestState - expected --rerun-failed without a previous run to fail")
+	}
+	for _, f := range []string{"state", "st1", "st2", "st3"} {
+		os.Remove("/tmp/luptests/" + f)
+	}
+}
+
+func TestStateKey(t *testing.T) {
+	dryRun = false
+	defer func() { stateFile, resume = "", false }()
+	os.MkdirAll("/tmp/luptests", 0700)
+	ioutil.WriteFile("/tmp/luptests/keys.txt", []byte("a\nb\n"), 0600)
+	args := []string{"--state-file", "/tmp/luptests/state", "sh", "-c", "echo >> /tmp/luptests/key_@lines:/tmp/luptests/keys.txt@ && false"}
+	c := newCommand(args...)
+	c.run()
+	ioutil.WriteFile("/tmp/luptests/keys.txt", []byte("c\nd\n"), 0600)
+	c = newCommand(append([]string{"--resume"}, args...)...)
+	if s := c.loadState(); s.found() {
+		t.Errorf("Failed TestStateKey - expected the state of commands which have since changed to be ignored, got %s", s.Statuses)
+	}
+	for _, f := range []string{"state", "keys.txt", "key_a", "key_b"} {
+		os.Remove("/tmp/luptests/" + f)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	defer tempState()()
+	s := &runState{path: stateFile}
+	s.checkpoint()
+	os.Remove(stateFile)
+	s.checkpoint()
+	if _, err := os.Stat(stateFile); err == nil {
+		t.Errorf("Failed TestCheckpoint - expected a save straight after another to be put off")
+	}
+	s.saved = s.saved.Add(-saveInterval)
+	s.checkpoint()
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Errorf("Failed TestCheckpoint - expected the state to be saved once saveInterval had passed")
+	}
+	c := newCommand("echo", "@stdin@")
+	if s := c.loadState(); s.path != "" {
+		t.Errorf("Failed TestCheckpoint - expected the state of an @stdin@ run not to be saved, got path %s", s.path)
+	}
+}
+
+func TestResumeOutput(t *testing.T) {
+	defer tempState()()
+	dryRun = false
+	defer func(stdout *os.File) { os.Stdout, resume, jobs = stdout, false, 1 }(os.Stdout)
+	args := []string{"-j", "2", "sh", "-c", "echo out@1..4@; test @1@ -ne 2"}
+	c := newCommand(args...)
+	c.run()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed TestResumeOutput - %s", err)
+	}
+	os.Stdout = w
+	c = newCommand(append([]string{"--resume"}, args...)...)
+	c.run()
+	w.Close()
+	data, _ := ioutil.ReadAll(r)
+	if string(data) != "out2\n" {
+		t.Errorf("Failed TestResumeOutput - expected the resumed command's output, got %q", data)
+	}
+}
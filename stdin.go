@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stream reads the @stdin@ group's terms from stdin a line at a time,
+// generating the commands for each line as soon as it arrives and handing
+// them to send, which reports false once no more should be started. Reading
+// stops when stdin ends or stop is cancelled
+func (c *command) stream(stop context.Context, mu *sync.Mutex, state *runState, send func(i int) bool) {
+	lines := make(chan string)
+	go readLines(os.Stdin, lines)
+	for {
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-stop.Done():
+		}
+		if !ok {
+			return
+		}
+		mu.Lock()
+		n := len(c.commands)
+		c.groups[c.stdin-1].terms = []string{c.stdinTerm(line)}
+		c.getCommands(0, []string{})
+		for i := n; i < len(c.commands); i++ {
+			c.results = append(c.results, result{})
+			state.Statuses = append(state.Statuses, "skipped")
+		}
+		mu.Unlock()
+		for i := n; i < len(c.commands); i++ {
+			if !send(i) {
+				return
+			}
+		}
+	}
+}
+
+// readLines sends each line read from r down lines, without its line
+// ending, closing lines once r is exhausted
+func readLines(r io.Reader, lines chan<- string) {
+	defer close(lines)
+	b := bufio.NewReader(r)
+	for {
+		line, err := b.ReadString('\n')
+		if line != "" {
+			lines <- strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't read from stdin", err)
+			return
+		}
+	}
+}
+
+// escapeLine turns a line read from stdin into a term which stays a single
+// argument, however it's quoted in the command. Outside of quotes, its
+// backslashes and whitespace are escaped along with its quotes. Inside
+// double quotes, which are left for a shell the command runs to read,
+// anything that shell would read as code is escaped
+func escapeLine(line string, inSingles bool, inDoubles bool) string {
+	if !inSingles && !inDoubles {
+		line = strings.Replace(line, "\\", "\\\\", -1)
+		line = strings.Replace(line, " ", "\\ ", -1)
+		line = strings.Replace(line, "\t", "\\\t", -1)
+	}
+	if inDoubles {
+		for _, c := range []string{"\\", "\"", "$", "`"} {
+			line = strings.Replace(line, c, "\\"+c, -1)
+		}
+	}
+	return escapeQuotes(line, inSingles, inDoubles)
+}
+
+// sharesStdin reports whether stdin has to be read in full before any
+// commands run, so that it can be given to each command, to each attempt at
+// one or split between them. Otherwise commands read stdin as it arrives,
+// and nothing is read from it at all on dry runs
+func (c *command) sharesStdin() bool {
+	return c.stdin == 0 && !dryRun && (len(c.commands) > 1 || retries > 0 || splitStdin != "")
+}
+
+// split shares the lines of stdin out between the commands, as chosen by
+// --split-stdin, exiting if they can't be shared out that way
+func (c *command) split() {
+	inputs, err := splitInput(input, len(c.commands))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't split stdin between the commands, %s\n", err)
+		os.Exit(3)
+	}
+	c.inputs = inputs
+}
+
+// splitInput deals the lines of input out between n commands, a line at a
+// time for round-robin, N lines at a time for chunks:N, and a line to each
+// command for records, in which case there must be as many lines as commands.
+// Lines keep their line endings, so the shares add up to input exactly
+func splitInput(input []byte, n int) ([][]byte, error) {
+	lines := bytes.SplitAfter(input, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	size := 1
+	switch {
+	case splitStdin == "records" && len(lines) != n:
+		return nil, fmt.Errorf("%d records were read but there are %d commands", len(lines), n)
+	case strings.HasPrefix(splitStdin, "chunks:"):
+		size, _ = strconv.Atoi(splitStdin[7:])
+	}
+	parts := make([][][]byte, n)
+	for i := 0; n > 0 && i < len(lines); i += size {
+		end := i + size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		k := i / size % n
+		parts[k] = append(parts[k], lines[i:end]...)
+	}
+	inputs := make([][]byte, n)
+	for k, part := range parts {
+		inputs[k] = bytes.Join(part, nil)
+	}
+	return inputs, nil
+}
+
+// stdinFor returns what the command at position i reads as its stdin: its
+// share of stdin, or the whole of it, read afresh for each attempt. Commands
+// get lup's own stdin when it's a terminal, and nothing when @stdin@ is
+// reading it
+func (c *command) stdinFor(i int) io.Reader {
+	switch {
+	case c.stdin > 0:
+		return nil
+	case c.inputs != nil:
+		return bytes.NewReader(c.inputs[i])
+	case input == nil:
+		return os.Stdin
+	}
+	return bytes.NewReader(input)
+}
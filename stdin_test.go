@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+var streamTests = []struct {
+	in string
+	s  []string
+	n  int
+	e  []string
+}{
+	{
+		in: "a b\nc,d\n",
+		s:  []string{"echo", "@stdin|upper@", "@x,y@", "@1@"},
+		e:  []string{"echo A\\ B x A\\ B", "echo A\\ B y A\\ B", "echo C,D x C,D", "echo C,D y C,D"},
+	},
+	{
+		in: "my file's \"name\".log\nback\\slash\tand $tab\n",
+		s:  []string{"gzip", "@stdin@"},
+		e:  []string{"gzip my\\ file\\'s\\ \\\"name\\\".log", "gzip back\\\\slash\\\tand\\ $tab"},
+	},
+	{
+		in: "a\"; echo INJECTED; echo \"b\n",
+		s:  []string{"sh", "-c", "echo \"@stdin@\""},
+		e:  []string{"sh -c 'echo \"a\\\"; echo INJECTED; echo \\\"b\"'"},
+	},
+	{
+		in: "1\r\n2\r\n3",
+		s:  []string{"echo", "@a,b@", "@n=stdin@", "@n@"},
+		e:  []string{"echo a 1 1", "echo b 1 1", "echo a 2 2", "echo b 2 2", "echo a 3 3", "echo b 3 3"},
+	},
+	{
+		in: "1\n2\n3\n",
+		s:  []string{"echo", "@stdin@"},
+		n:  2,
+		e:  []string{"echo 1", "echo 2"},
+	},
+}
+
+func TestStream(t *testing.T) {
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	for _, x := range streamTests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("Failed TestStream - %s", err)
+		}
+		os.Stdin = r
+		w.WriteString(x.in)
+		w.Close()
+		c := newCommand(x.s...)
+		var got []string
+		c.stream(context.Background(), &sync.Mutex{}, &runState{}, func(i int) bool {
+			got = append(got, c.commands[i])
+			return x.n == 0 || len(got) < x.n
+		})
+		if strings.Join(got, "\n") != strings.Join(x.e, "\n") {
+			t.Errorf("Failed TestStream on %s - expected %q, got %q", x.s, x.e, got)
+		}
+		if len(c.results) != len(c.commands) {
+			t.Errorf("Failed TestStream on %s - expected %d results, got %d", x.s, len(c.commands), len(c.results))
+		}
+		r.Close()
+	}
+}
+
+var splitInputTests = []struct {
+	mode  string
+	input string
+	n     int
+	e     []string
+}{
+	{"round-robin", "1\n2\n3\n4\n5", 2, []string{"1\n3\n5", "2\n4\n"}},
+	{"round-robin", "1\n", 3, []string{"1\n", "", ""}},
+	{"chunks:2", "1\n2\n3\n4\n5\n6\n7\n", 3, []string{"1\n2\n7\n", "3\n4\n", "5\n6\n"}},
+	{"chunks:5", "1\n2\n3", 2, []string{"1\n2\n3", ""}},
+	{"records", "a b\r\n\x00c\n", 2, []string{"a b\r\n", "\x00c\n"}},
+	{"round-robin", "", 2, []string{"", ""}},
+}
+
+func TestSplitInput(t *testing.T) {
+	defer func() { splitStdin = "" }()
+	for _, x := range splitInputTests {
+		splitStdin = x.mode
+		result, err := splitInput([]byte(x.input), x.n)
+		if err != nil {
+			t.Errorf("Failed TestSplitInput on %s %q - %s", x.mode, x.input, err)
+			continue
+		}
+		if len(result) != len(x.e) {
+			t.Errorf("Failed TestSplitInput on %s %q - expected %q, got %q", x.mode, x.input, x.e, result)
+			continue
+		}
+		for i, r := range result {
+			if string(r) != x.e[i] {
+				t.Errorf("Failed TestSplitInput on %s %q - expected %q, got %q", x.mode, x.input, x.e, result)
+				break
+			}
+		}
+	}
+	splitStdin = "records"
+	if _, err := splitInput([]byte("a\nb\nc"), 2); err == nil {
+		t.Errorf("Failed TestSplitInput - expected an error splitting 3 records between 2 commands")
+	}
+}
+
+var escapeLineTests = []string{
+	"plain",
+	"my file's \"name\".log",
+	"back\\slash\tand  $HOME `id` $(id)",
+	"a\"; echo INJECTED; echo \"b",
+}
+
+func TestEscapeLine(t *testing.T) {
+	for _, x := range escapeLineTests {
+		if args, err := shellquote.Split("gzip " + escapeLine(x, false, false)); err != nil || len(args) != 2 || args[1] != x {
+			t.Errorf("Failed TestEscapeLine on %q - expected a single argument, got %q (%v)", x, args, err)
+		}
+		out, err := exec.Command("sh", "-c", "printf %s \""+escapeLine(x, false, true)+"\"").Output()
+		if err != nil || string(out) != x {
+			t.Errorf("Failed TestEscapeLine on %q - expected the shell to print it as it was, got %q (%v)", x, out, err)
+		}
+	}
+	c := newCommand("sh", "-c", "echo \"@$HOME,`id`@\"")
+	if e := "sh -c 'echo \"$HOME\"'"; c.commands[0] != e {
+		t.Errorf("Failed TestEscapeLine - expected terms typed in the command to be left for the shell, got %s", c.commands[0])
+	}
+}
+
+var sharesStdinTests = []struct {
+	s       []string
+	dryRun  bool
+	retries int
+	split   string
+	e       bool
+}{
+	{s: []string{"echo", "@a@"}, e: false},
+	{s: []string{"echo", "@a,b@"}, e: true},
+	{s: []string{"echo", "@a,b@"}, dryRun: true, e: false},
+	{s: []string{"echo", "@a@"}, retries: 1, e: true},
+	{s: []string{"echo", "@a@"}, split: "records", e: true},
+	{s: []string{"echo", "@stdin@"}, e: false},
+}
+
+func TestSharesStdin(t *testing.T) {
+	defer func() { dryRun, retries, splitStdin = false, 0, "" }()
+	for _, x := range sharesStdinTests {
+		dryRun, retries, splitStdin = x.dryRun, x.retries, x.split
+		c := newCommand(x.s...)
+		if r := c.sharesStdin(); r != x.e {
+			t.Errorf("Failed TestSharesStdin on %s (dry run %t, retries %d, split %q) - expected %t, got %t", x.s, x.dryRun, x.retries, x.split, x.e, r)
+		}
+	}
+}
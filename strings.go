@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -25,10 +25,6 @@ func (t *state) toggle(src rune, match rune, disableOnNoMatch bool) {
 	}
 }
 
-func lupGroup(i int) (s string) {
-	return fmt.Sprintf("##LUP_GROUP_%d##", i)
-}
-
 func isHidden(text string) (b bool, s string) {
 	if strings.HasPrefix(text, hider) {
 		b = true
@@ -39,6 +35,13 @@ func isHidden(text string) (b bool, s string) {
 	return b, s
 }
 
+func isLinked(text string) (b bool, s string) {
+	if strings.HasPrefix(text, linker) {
+		return true, text[len(linker):]
+	}
+	return false, text
+}
+
 func addSlashes(word string) string {
 	delimiter := '@'
 	word = strings.Replace(word, string(delimiter), "\\"+string(delimiter), -1)
@@ -52,6 +55,24 @@ func stripSlashes(word string) string {
 	return word
 }
 
+// unquote removes the backslashes the shell would from text, which is found
+// inside single quotes, double quotes or neither. Inside single quotes, only
+// the single quotes escaped by closing and reopening the quotes are put back
+func unquote(text string, inSingles bool, inDoubles bool) string {
+	if inSingles {
+		return strings.Replace(text, `'\''`, "'", -1)
+	}
+	var b strings.Builder
+	chars := []rune(text)
+	for i := 0; i < len(chars); i++ {
+		if chars[i] == '\\' && i+1 < len(chars) && (!inDoubles || strings.ContainsRune("$`\"\\\n", chars[i+1])) {
+			i++
+		}
+		b.WriteRune(chars[i])
+	}
+	return b.String()
+}
+
 func runeIn(group []rune, r rune) (b bool) {
 	for _, x := range group {
 		if string(x) == string(r) {
@@ -83,3 +104,29 @@ func unescapeGlobChars(text string) string {
 	}
 	return text
 }
+
+// isList reports whether the contents of an @ group hold more than a single
+// literal term, i.e. a comma separated list, a range or a directive
+func isList(text string) bool {
+	var escaping state
+	for _, char := range text {
+		if !escaping.on && char == ',' {
+			return true
+		}
+		escaping.toggle(char, '\\', true)
+	}
+	return strings.Contains(text, "..") || regexp.MustCompile(`^[a-z-]+:`).MatchString(text)
+}
+
+// hasUnescapedSpace reports whether text contains whitespace which isn't
+// escaped with a backslash
+func hasUnescapedSpace(text string) bool {
+	var escaping state
+	for _, char := range text {
+		if !escaping.on && strings.ContainsRune(" \t\n", char) {
+			return true
+		}
+		escaping.toggle(char, '\\', true)
+	}
+	return false
+}
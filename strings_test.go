@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"testing"
 )
 
@@ -27,14 +26,6 @@ var stripSlashesTests = []struct {
 	{"Test \\,comma", "Test ,comma"},
 }
 
-var lupGroupTests = []struct {
-	s int
-	e string
-}{
-	{1, fmt.Sprintf("##LUP_GROUP_%d##", 1)},
-	{99, fmt.Sprintf("##LUP_GROUP_%d##", 99)},
-}
-
 var addSlashesTests = []struct {
 	s string
 	e string
@@ -181,14 +172,6 @@ func TestAddSlashes(t *testing.T) {
 	}
 }
 
-func TestLupGroup(t *testing.T) {
-	for _, x := range lupGroupTests {
-		result := lupGroup(x.s)
-		if result != x.e {
-			t.Errorf("lupGroup failed. Got: %s, Want: %s", result, x.e)
-		}
-	}
-}
 func TestToggle(t *testing.T) {
 	for _, x := range toggleTests {
 		x.st.toggle(x.s, x.m, x.d)
@@ -206,3 +189,23 @@ func TestIsHidden(t *testing.T) {
 		}
 	}
 }
+
+var isListTests = []struct {
+	s string
+	e bool
+}{
+	{"com,net", true},
+	{"1..3", true},
+	{"lines:/tmp/hosts", true},
+	{"-:a", true},
+	{"com\\,net", false},
+	{"_", false},
+}
+
+func TestIsList(t *testing.T) {
+	for _, x := range isListTests {
+		if result := isList(x.s); result != x.e {
+			t.Errorf("isList failed on '%s'", x.s)
+		}
+	}
+}